@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/pkg/env"
+	"github.com/kooroshh/fiber-boostrap/pkg/response"
+)
+
+// LoginThrottleConfig holds the brute-force protection of Login. Failed logins are
+// counted per existing username and per IP address. Once a counter exceeds its free attempts,
+// every further failure blocks logins for it with an exponentially growing delay,
+// from BackoffBase up to BackoffMax. A username reaching LockoutThreshold failures is
+// locked for LockoutDuration. Failures older than Window are forgotten.
+type LoginThrottleConfig struct {
+	FreeAttempts     int
+	IPFreeAttempts   int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	Window           time.Duration
+}
+
+var loginThrottle = LoginThrottleConfig{
+	FreeAttempts:     3,
+	IPFreeAttempts:   20,
+	BackoffBase:      time.Second,
+	BackoffMax:       5 * time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	Window:           15 * time.Minute,
+}
+
+// SetupLoginThrottle overrides the defaults of the login brute-force protection with
+// the LOGIN_FREE_ATTEMPTS, LOGIN_IP_FREE_ATTEMPTS, LOGIN_BACKOFF_BASE,
+// LOGIN_BACKOFF_MAX, LOGIN_LOCKOUT_THRESHOLD, LOGIN_LOCKOUT_DURATION and
+// LOGIN_ATTEMPT_WINDOW environment variables. Durations use time.ParseDuration
+// syntax, e.g. "15m". Invalid values are logged and ignored.
+func SetupLoginThrottle() {
+	loginThrottle = LoginThrottleConfig{
+		FreeAttempts:     env.GetInt("LOGIN_FREE_ATTEMPTS", loginThrottle.FreeAttempts),
+		IPFreeAttempts:   env.GetInt("LOGIN_IP_FREE_ATTEMPTS", loginThrottle.IPFreeAttempts),
+		BackoffBase:      env.GetDuration("LOGIN_BACKOFF_BASE", loginThrottle.BackoffBase),
+		BackoffMax:       env.GetDuration("LOGIN_BACKOFF_MAX", loginThrottle.BackoffMax),
+		LockoutThreshold: env.GetInt("LOGIN_LOCKOUT_THRESHOLD", loginThrottle.LockoutThreshold),
+		LockoutDuration:  env.GetDuration("LOGIN_LOCKOUT_DURATION", loginThrottle.LockoutDuration),
+		Window:           env.GetDuration("LOGIN_ATTEMPT_WINDOW", loginThrottle.Window),
+	}
+}
+
+// loginThrottlePurgeBatch is the most counters PurgeLoginThrottles deletes with one
+// statement, so that a purge only holds few row locks at a time.
+const loginThrottlePurgeBatch = 1000
+
+// PurgeLoginThrottles deletes the forgotten failed login counters, e.g. the ones of
+// one-off IP addresses, once every Window until ctx is done. It runs apart from the
+// login attempts so that they never wait for it.
+func PurgeLoginThrottles(ctx context.Context) {
+	if loginThrottle.Window <= 0 {
+		log.Println("login attempt window is not positive, not purging login throttles")
+		return
+	}
+	ticker := time.NewTicker(loginThrottle.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		purgeLoginThrottles(ctx, time.Now())
+	}
+}
+
+// purgeLoginThrottles deletes the counters forgotten at now in batches.
+func purgeLoginThrottles(ctx context.Context, now time.Time) {
+	for {
+		deleted, err := repos.LoginThrottles.DeleteForgottenLoginThrottles(ctx, now.Add(-loginThrottle.Window), now, loginThrottlePurgeBatch)
+		if err != nil {
+			log.Println("failed to purge login throttles: ", err)
+			return
+		}
+		if deleted < loginThrottlePurgeBatch {
+			return
+		}
+	}
+}
+
+func loginUserKey(username string) string {
+	return "user:" + username
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginCounter is a failed login counter, see LoginThrottleRepository, together with
+// the blocks its failures lead to.
+type loginCounter struct {
+	key   string
+	block repository.LoginBlockFunc
+}
+
+func userLoginCounter(username string) loginCounter {
+	return loginCounter{key: loginUserKey(username), block: userLoginBlock}
+}
+
+func ipLoginCounter(ip string) loginCounter {
+	return loginCounter{key: loginIPKey(ip), block: ipLoginBlock}
+}
+
+// userLoginBlock locks the account once the failures reach LockoutThreshold and backs
+// off after FreeAttempts failures before that.
+func userLoginBlock(failures int) (time.Duration, bool) {
+	if failures >= loginThrottle.LockoutThreshold {
+		return loginThrottle.LockoutDuration, true
+	}
+	return loginBackoff(failures - loginThrottle.FreeAttempts), false
+}
+
+// ipLoginBlock backs off after IPFreeAttempts failures of an IP address.
+func ipLoginBlock(failures int) (time.Duration, bool) {
+	return loginBackoff(failures - loginThrottle.IPFreeAttempts), false
+}
+
+// reserveLoginAttempt counts a login attempt on every counter before the password is
+// checked, see LoginThrottleRepository.ReserveLoginAttempt, and returns the counters.
+// When a counter blocks the attempt, the attempt is taken back from the counters it
+// was already counted on and the blocking counter is returned as well.
+func reserveLoginAttempt(spanCtx context.Context, counters []loginCounter, now time.Time) ([]models.LoginThrottle, *models.LoginThrottle, error) {
+	throttles := make([]models.LoginThrottle, 0, len(counters))
+	for i, counter := range counters {
+		throttle, reserved, err := repos.LoginThrottles.ReserveLoginAttempt(spanCtx, counter.key, now, loginThrottle.Window, counter.block)
+		if err != nil || !reserved {
+			releaseLoginAttempt(spanCtx, counters[:i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to count login attempt: %v", err)
+			}
+			return nil, &throttle, nil
+		}
+		throttles = append(throttles, throttle)
+	}
+	return throttles, nil, nil
+}
+
+// releaseLoginAttempt takes back a login attempt that did not fail from the counters.
+// Failing to do so is logged.
+func releaseLoginAttempt(spanCtx context.Context, counters []loginCounter) {
+	for _, counter := range counters {
+		if err := repos.LoginThrottles.ReleaseLoginAttempt(spanCtx, counter.key, counter.block); err != nil {
+			log.Println("failed to release login attempt: ", err)
+		}
+	}
+}
+
+// sendLoginBlocked refuses a login blocked by throttle with a Retry-After header: 423
+// Locked for an account lockout, 429 Too Many Requests for a backoff delay.
+func sendLoginBlocked(ctx *fiber.Ctx, throttle models.LoginThrottle, now time.Time) error {
+	retryAfter := int(math.Ceil(throttle.BlockedUntil.Sub(now).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	ctx.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	data := fiber.Map{"retry_after": retryAfter}
+
+	if throttle.Locked {
+		return response.SendFailureResponse(ctx, fiber.StatusLocked, "account is temporarily locked", data)
+	}
+	return response.SendFailureResponse(ctx, fiber.StatusTooManyRequests, "too many failed login attempts, try again later", data)
+}
+
+// recordLoginLockout records the lockout of the account of user as a security event,
+// if the failed login locked its counter.
+func recordLoginLockout(ctx *fiber.Ctx, spanCtx context.Context, user models.User, throttle models.LoginThrottle) {
+	if !throttle.Locked {
+		return
+	}
+	recordSecurityEvent(ctx, spanCtx, models.SecurityEvent{
+		UserID:   user.ID,
+		Username: user.Username,
+		Event:    models.SecurityEventAccountLocked,
+		Detail:   fmt.Sprintf("%d failed login attempts, locked until %s", throttle.Failures, throttle.BlockedUntil.Format(time.RFC3339)),
+	})
+}
+
+// loginBackoff returns the delay after the n-th failure beyond the free attempts:
+// BackoffBase doubled for every failure, at most BackoffMax, and 0 while n is not
+// positive.
+func loginBackoff(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	if n > 30 {
+		return loginThrottle.BackoffMax
+	}
+	delay := loginThrottle.BackoffBase << (n - 1)
+	if delay <= 0 || delay > loginThrottle.BackoffMax {
+		return loginThrottle.BackoffMax
+	}
+	return delay
+}
@@ -1,6 +1,13 @@
 package controllers
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
+	"github.com/kooroshh/fiber-boostrap/pkg/jwt_token"
+	"github.com/kooroshh/fiber-boostrap/pkg/response"
+)
 
 // RenderUI renders the "index" HTML page using the fiber context.
 // It does not pass any data to the template.
@@ -8,3 +15,19 @@ import "github.com/gofiber/fiber/v2"
 func RenderUI(c *fiber.Ctx) error {
 	return c.Render("index", nil)
 }
+
+// GetWSMetrics handles the HTTP request to read the connection counters of the
+// WebSocket hub: the active connections and, since startup, the accepted connections
+// and the connections that were reaped because their peer stopped responding.
+func GetWSMetrics(ctx *fiber.Ctx) error {
+	return response.SendSuccessResponse(ctx, ws.DefaultHub.Metrics())
+}
+
+// GetJWKS handles the HTTP request for the JSON Web Key Set of the public keys the
+// tokens are signed with, so that other services can verify them. The document follows
+// RFC 7517 instead of the usual response envelope and may be cached for five minutes,
+// keys scheduled for rotation are listed before they start signing.
+func GetJWKS(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.JSON(jwt_token.JWKS(time.Now()))
+}
@@ -1,25 +1,554 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
 	"github.com/kooroshh/fiber-boostrap/pkg/response"
 	"go.elastic.co/apm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+	maxSearchLength     = 256
 )
 
 // GetHistory handles the HTTP request to retrieve the history of messages.
-// It initiates a trace span for monitoring, retrieves all messages from the repository,
-// and sends a success response with the messages or a failure response in case of an error.
+// It initiates a trace span for monitoring, retrieves one page of the messages of the
+// room given by the optional room_id query parameter (or the global channel when it is
+// absent) from the repository, and sends a success response with the messages, including
+// their reaction summaries, and the cursor of the next page or a failure response in
+// case of an error. Only members can read the history of a room. Paging is controlled
+// by the before, after and limit query parameters, see parseHistoryQuery.
 func GetHistory(ctx *fiber.Ctx) error {
 	span, spanCtx := apm.StartSpan(ctx.Context(), "GetHistory", "controller")
 	defer span.End()
 
-	resp, err := repository.GetAllMessage(spanCtx)
+	roomID := ctx.QueryInt("room_id", 0)
+	if roomID < 0 {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "invalid room id", nil)
+	}
+
+	query, fErr := parseHistoryQuery(ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	if roomID != 0 {
+		isMember, err := repos.Rooms.IsRoomMember(spanCtx, uint(roomID), ctx.Locals("user_id").(uint))
+		if err != nil {
+			log.Println(err)
+			return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+		}
+		if !isMember {
+			return response.SendFailureResponse(ctx, fiber.StatusForbidden, "not a member of the room", nil)
+		}
+	}
+
+	messages, err := repos.Messages.GetAllMessage(spanCtx, uint(roomID), query)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	return response.SendSuccessResponse(ctx, newHistoryResponse(messages, query))
+}
+
+// GetDirectHistory handles the HTTP request to retrieve the direct messages between the
+// authenticated user and the user given by the :username parameter. The conversation is
+// derived from the caller's own user ID, so nobody can read a conversation they are not
+// a participant of. It accepts the same paging parameters as GetHistory and responds with
+// the messages and the cursor of the next page or a failure response in case of an error.
+func GetDirectHistory(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetDirectHistory", "controller")
+	defer span.End()
+
+	query, fErr := parseHistoryQuery(ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	other, err := repos.Users.GetUserByUsername(spanCtx, ctx.Params("username"))
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get user by username: %v", err))
+		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "user not found", nil)
+	}
+
+	conversationID := models.DirectConversationID(ctx.Locals("user_id").(uint), other.ID)
+	messages, err := repos.Messages.GetDirectMessages(spanCtx, conversationID, query)
 	if err != nil {
 		log.Println(err)
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
 	}
+	return response.SendSuccessResponse(ctx, newHistoryResponse(messages, query))
+}
+
+// GetThread handles the HTTP request to retrieve the thread of the message identified by
+// the :id parameter. When the message is itself a reply, the thread it belongs to is
+// returned. The caller must be able to read the conversation of the thread. It accepts
+// the same paging parameters as GetHistory and responds with the root message, the
+// replies and the cursor of the next page or a failure response in case of an error.
+func GetThread(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetThread", "controller")
+	defer span.End()
+
+	query, fErr := parseHistoryQuery(ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	actor := actorFromLocals(ctx)
+	root, err := ws.GetAccessibleMessage(spanCtx, ws.DefaultHub, actor, ctx.Params("id"))
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
+	if root.ThreadRoot != nil {
+		root, err = ws.GetAccessibleMessage(spanCtx, ws.DefaultHub, actor, root.ThreadRoot.Hex())
+		if err != nil {
+			return sendEventError(ctx, err)
+		}
+	}
+
+	messages, err := repos.Messages.GetThreadMessages(spanCtx, root.ID, query)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	resp := newHistoryResponse(messages, query)
+	resp.Root = &root
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// SearchMessages handles the HTTP request to search the messages for the text given by
+// the q query parameter. Only messages the authenticated user can read are returned:
+// the global channel, the rooms the user is a member of and the user's own direct
+// conversations; deleted messages are left out. The results can be narrowed with the
+// from (sender username), room_id, since and until (Unix milliseconds, inclusive)
+// query parameters and are ordered by relevance unless sort=date is given. Pages are
+// selected with the limit and cursor query parameters. It responds with the matching
+// messages and the cursor of the next page or a failure response in case of an error.
+func SearchMessages(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "SearchMessages", "controller")
+	defer span.End()
+
+	query, fErr := parseSearchQuery(ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	userID := ctx.Locals("user_id").(uint)
+	if query.RoomID != 0 {
+		isMember, err := repos.Rooms.IsRoomMember(spanCtx, query.RoomID, userID)
+		if err != nil {
+			log.Println(err)
+			return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+		}
+		if !isMember {
+			return response.SendFailureResponse(ctx, fiber.StatusForbidden, "not a member of the room", nil)
+		}
+	}
+
+	roomIDs, err := repos.Rooms.GetRoomIDsOfMember(spanCtx, userID)
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get rooms of member: %v", err))
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	messages, err := repos.Messages.SearchMessages(spanCtx, query, ctx.Locals("username").(string), roomIDs)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	resp := models.MessageSearchResponse{Messages: messages}
+	if messages == nil {
+		resp.Messages = []models.MessagePayload{}
+	}
+	if int64(len(messages)) == query.Limit {
+		resp.NextCursor = strconv.FormatInt(query.Offset+query.Limit, 10)
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// EditMessage handles the HTTP request to replace the text of the message identified by
+// the :id parameter with the message field of the request body. The author and
+// moderators can edit a message; the previous text is kept in the message's edit history and connected
+// clients receive a message.updated event. It responds with the updated message or a
+// failure response in case of an error.
+func EditMessage(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "EditMessage", "controller")
+	defer span.End()
+
+	req := new(models.EditMessageRequest)
+	err := ctx.BodyParser(req)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to parse body request: %v", err)
+		log.Println("Failed to parse body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	err = req.Validate()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to validate body request: %v", err)
+		log.Println("Failed to validate body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	resp, err := ws.EditMessage(spanCtx, ws.DefaultHub, actorFromLocals(ctx), ctx.Params("id"), req.Message)
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// DeleteMessage handles the HTTP request to delete the message identified by the :id
+// parameter. The author and moderators can delete a message; it is kept as a tombstone
+// without text and connected clients receive a message.deleted event. It responds with
+// the tombstone or a failure response in case of an error.
+func DeleteMessage(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "DeleteMessage", "controller")
+	defer span.End()
+
+	resp, err := ws.DeleteMessage(spanCtx, ws.DefaultHub, actorFromLocals(ctx), ctx.Params("id"))
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// AddReaction handles the HTTP request to react to the message identified by the :id
+// parameter with the emoji given in the request body. Each user reacts at most once per
+// emoji and connected clients receive a reaction.updated event. It responds with the
+// message and its reaction summary or a failure response in case of an error.
+func AddReaction(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "AddReaction", "controller")
+	defer span.End()
+
+	req := new(models.ReactionRequest)
+	err := ctx.BodyParser(req)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to parse body request: %v", err)
+		log.Println("Failed to parse body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	err = req.Validate()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to validate body request: %v", err)
+		log.Println("Failed to validate body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	resp, err := ws.AddReaction(spanCtx, ws.DefaultHub, actorFromLocals(ctx), ctx.Params("id"), req.Emoji)
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// RemoveReaction handles the HTTP request to remove the authenticated user's reaction
+// with the URL-encoded :emoji parameter from the message identified by the :id
+// parameter. It responds with the message and its reaction summary or a failure
+// response in case of an error.
+func RemoveReaction(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "RemoveReaction", "controller")
+	defer span.End()
+
+	emoji, err := url.PathUnescape(ctx.Params("emoji"))
+	if err != nil {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "invalid emoji", nil)
+	}
+
+	resp, err := ws.RemoveReaction(spanCtx, ws.DefaultHub, actorFromLocals(ctx), ctx.Params("id"), emoji)
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
 	return response.SendSuccessResponse(ctx, resp)
 }
+
+// UpdateReadMarker handles the HTTP request to move the authenticated user's read
+// marker of a conversation forward to the message given by message_id in the request
+// body. The conversation is the one the message belongs to, and the user must be able
+// to see it. A marker already pointing at a newer message is left unchanged. It responds
+// with the current read marker or a failure response in case of an error.
+func UpdateReadMarker(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "UpdateReadMarker", "controller")
+	defer span.End()
+
+	req := new(models.ReadMarkerRequest)
+	err := ctx.BodyParser(req)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to parse body request: %v", err)
+		log.Println("Failed to parse body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	err = req.Validate()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to validate body request: %v", err)
+		log.Println("Failed to validate body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	msg, err := ws.GetAccessibleMessage(spanCtx, ws.DefaultHub, actorFromLocals(ctx), req.MessageID)
+	if err != nil {
+		return sendEventError(ctx, err)
+	}
+
+	_, err = repos.Messages.UpsertReadMarker(spanCtx, models.ReadMarker{
+		Username:     ctx.Locals("username").(string),
+		Conversation: msg.ConversationKey(),
+		MessageID:    msg.ID,
+		MessageDate:  msg.Date,
+		UpdatedAt:    time.Now(),
+	})
+	if err != nil {
+		errResponse := fmt.Errorf("failed to upsert read marker: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return sendReadMarker(spanCtx, ctx, msg.RoomID, msg.ConversationID, msg.ConversationKey())
+}
+
+// GetReadMarker handles the HTTP request to retrieve the authenticated user's read
+// marker and unread count of a conversation: the room given by the room_id query
+// parameter, the direct conversation with the user given by the username query
+// parameter, or the global channel when both are absent.
+func GetReadMarker(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetReadMarker", "controller")
+	defer span.End()
+
+	roomID := ctx.QueryInt("room_id", 0)
+	otherUsername := ctx.Query("username")
+	switch {
+	case roomID < 0 || (roomID != 0 && otherUsername != ""):
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "either room_id or username is allowed", nil)
+	case roomID != 0:
+		isMember, err := repos.Rooms.IsRoomMember(spanCtx, uint(roomID), ctx.Locals("user_id").(uint))
+		if err != nil {
+			log.Println(err)
+			return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+		}
+		if !isMember {
+			return response.SendFailureResponse(ctx, fiber.StatusForbidden, "not a member of the room", nil)
+		}
+		msg := models.MessagePayload{RoomID: uint(roomID)}
+		return sendReadMarker(spanCtx, ctx, msg.RoomID, "", msg.ConversationKey())
+	case otherUsername != "":
+		other, err := repos.Users.GetUserByUsername(spanCtx, otherUsername)
+		if err != nil {
+			log.Println(fmt.Errorf("failed to get user by username: %v", err))
+			return response.SendFailureResponse(ctx, fiber.StatusNotFound, "user not found", nil)
+		}
+		conversationID := models.DirectConversationID(ctx.Locals("user_id").(uint), other.ID)
+		return sendReadMarker(spanCtx, ctx, 0, conversationID, conversationID)
+	default:
+		return sendReadMarker(spanCtx, ctx, 0, "", models.GlobalConversationKey)
+	}
+}
+
+// sendReadMarker responds with the authenticated user's read marker of a conversation
+// together with the number of messages received there after it.
+func sendReadMarker(spanCtx context.Context, ctx *fiber.Ctx, roomID uint, conversationID string, conversation string) error {
+	username := ctx.Locals("username").(string)
+
+	marker, err := repos.Messages.GetReadMarker(spanCtx, username, conversation)
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get read marker: %v", err))
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	marker.UnreadCount, err = repos.Messages.CountUnreadMessages(spanCtx, roomID, conversationID, username, models.HistoryCursor{Date: marker.MessageDate, ID: marker.MessageID})
+	if err != nil {
+		log.Println(fmt.Errorf("failed to count unread messages: %v", err))
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return response.SendSuccessResponse(ctx, marker)
+}
+
+// parseHistoryQuery reads the paging parameters of a history request. before and after
+// are cursors as returned in next_cursor, see formatHistoryCursor, and limit is the page size, defaulting to defaultHistoryLimit and capped at
+// maxHistoryLimit. Without after the newest page before the before cursor is returned.
+func parseHistoryQuery(ctx *fiber.Ctx) (models.MessageHistoryQuery, *fiber.Error) {
+	var (
+		query = models.MessageHistoryQuery{Limit: defaultHistoryLimit}
+		err   error
+	)
+
+	if before := ctx.Query("before"); before != "" {
+		if query.Before, err = parseHistoryCursor(before); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "invalid before cursor")
+		}
+	}
+
+	if after := ctx.Query("after"); after != "" {
+		if query.After, err = parseHistoryCursor(after); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "invalid after cursor")
+		}
+	}
+
+	limit := ctx.QueryInt("limit", defaultHistoryLimit)
+	if limit <= 0 {
+		return query, fiber.NewError(fiber.StatusBadRequest, "invalid limit")
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	query.Limit = int64(limit)
+
+	return query, nil
+}
+
+// parseSearchQuery reads the parameters of a search request. The cursor is the offset
+// of the page as returned in next_cursor and limit the page size, defaulting to
+// defaultHistoryLimit and capped at maxHistoryLimit.
+func parseSearchQuery(ctx *fiber.Ctx) (models.MessageSearchQuery, *fiber.Error) {
+	var (
+		query = models.MessageSearchQuery{
+			Text: strings.TrimSpace(ctx.Query("q")),
+			From: ctx.Query("from"),
+			Sort: ctx.Query("sort", models.SearchSortRelevance),
+		}
+		err error
+	)
+
+	if query.Text == "" {
+		return query, fiber.NewError(fiber.StatusBadRequest, "missing search text")
+	}
+	if len(query.Text) > maxSearchLength {
+		return query, fiber.NewError(fiber.StatusBadRequest, "search text too long")
+	}
+	if query.Sort != models.SearchSortRelevance && query.Sort != models.SearchSortDate {
+		return query, fiber.NewError(fiber.StatusBadRequest, "invalid sort")
+	}
+
+	roomID := ctx.QueryInt("room_id", 0)
+	if roomID < 0 {
+		return query, fiber.NewError(fiber.StatusBadRequest, "invalid room id")
+	}
+	query.RoomID = uint(roomID)
+
+	if since := ctx.Query("since"); since != "" {
+		if query.Since, err = parseUnixMillis(since); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "invalid since")
+		}
+	}
+	if until := ctx.Query("until"); until != "" {
+		if query.Until, err = parseUnixMillis(until); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "invalid until")
+		}
+	}
+
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		if query.Offset, err = strconv.ParseInt(cursor, 10, 64); err != nil || query.Offset < 0 {
+			return query, fiber.NewError(fiber.StatusBadRequest, "invalid cursor")
+		}
+	}
+
+	limit := ctx.QueryInt("limit", defaultHistoryLimit)
+	if limit <= 0 {
+		return query, fiber.NewError(fiber.StatusBadRequest, "invalid limit")
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	query.Limit = int64(limit)
+
+	return query, nil
+}
+
+// newHistoryResponse wraps a page of messages together with the cursor of the next
+// page in the same direction. The cursor is empty when the page was not full, which
+// means there is nothing left to read.
+func newHistoryResponse(messages []models.MessagePayload, query models.MessageHistoryQuery) models.MessageHistoryResponse {
+	resp := models.MessageHistoryResponse{Messages: messages}
+	if messages == nil {
+		resp.Messages = []models.MessagePayload{}
+	}
+
+	if int64(len(messages)) < query.Limit {
+		return resp
+	}
+	if query.After.IsZero() {
+		resp.NextCursor = formatHistoryCursor(messages[0])
+	} else {
+		resp.NextCursor = formatHistoryCursor(messages[len(messages)-1])
+	}
+	return resp
+}
+
+// formatHistoryCursor returns the cursor of msg: its date in Unix milliseconds and its
+// ID, separated by an underscore.
+func formatHistoryCursor(msg models.MessagePayload) string {
+	return strconv.FormatInt(msg.Date.UnixMilli(), 10) + "_" + msg.ID.Hex()
+}
+
+// parseHistoryCursor parses a cursor returned by formatHistoryCursor. A bare date in
+// Unix milliseconds is accepted as well and bounds the page by date only.
+func parseHistoryCursor(cursor string) (models.HistoryCursor, error) {
+	millis, id, hasID := strings.Cut(cursor, "_")
+	date, err := parseUnixMillis(millis)
+	if err != nil {
+		return models.HistoryCursor{}, err
+	}
+	if !hasID {
+		return models.HistoryCursor{Date: date}, nil
+	}
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.HistoryCursor{}, err
+	}
+	return models.HistoryCursor{Date: date, ID: objectID}, nil
+}
+
+func parseUnixMillis(value string) (time.Time, error) {
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// actorFromLocals returns the authenticated user set by MiddlewareValidateAuth.
+func actorFromLocals(ctx *fiber.Ctx) ws.Actor {
+	return ws.Actor{UserID: ctx.Locals("user_id").(uint), Username: ctx.Locals("username").(string)}
+}
+
+// sendEventError responds to an error returned by the ws package. Errors caused by the
+// request carry an error code which is mapped to the matching HTTP status, any other
+// error is logged and answered with an internal server error.
+func sendEventError(ctx *fiber.Ctx, err error) error {
+	eventErr, ok := err.(*ws.EventError)
+	if !ok {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	status := fiber.StatusInternalServerError
+	switch eventErr.Code {
+	case models.ErrorCodeBadRequest:
+		status = fiber.StatusBadRequest
+	case models.ErrorCodeForbidden:
+		status = fiber.StatusForbidden
+	case models.ErrorCodeNotFound:
+		status = fiber.StatusNotFound
+	case models.ErrorCodeConflict:
+		status = fiber.StatusConflict
+	case models.ErrorCodeMessageTooLong:
+		status = fiber.StatusRequestEntityTooLarge
+	case models.ErrorCodeRateLimited:
+		status = fiber.StatusTooManyRequests
+	}
+	return response.SendFailureResponse(ctx, status, eventErr.Message, nil)
+}
@@ -0,0 +1,12 @@
+package controllers
+
+import "github.com/kooroshh/fiber-boostrap/app/repository"
+
+// repos holds the repositories the controllers read and write through.
+var repos repository.Repositories
+
+// SetupRepositories sets the repositories used by the controllers. It must be called
+// before the routes are served; tests can pass repository.NewMemoryRepositories().
+func SetupRepositories(r repository.Repositories) {
+	repos = r
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/pkg/response"
+	"go.elastic.co/apm"
+	"gorm.io/gorm"
+)
+
+// CreateRoom handles the HTTP request to create a new chat room.
+// It parses and validates the room from the request body, makes the authenticated
+// user its owner and first member, and stores it in the database.
+// It responds with the created room or with an error message if any step fails.
+func CreateRoom(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "CreateRoom", "controller")
+	defer span.End()
+
+	room := new(models.Room)
+
+	err := ctx.BodyParser(room)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to parse body request: %v", err)
+		log.Println("Failed to parse body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	err = room.Validate()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to validate body request: %v", err)
+		log.Println("Failed to validate body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	room.ID = 0
+	room.OwnerID = ctx.Locals("user_id").(uint)
+
+	err = repos.Rooms.InsertNewRoom(spanCtx, room)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to insert new room: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return response.SendSuccessResponse(ctx, room)
+}
+
+// GetRooms handles the HTTP request to list the rooms visible to the authenticated
+// user, which are all public rooms plus the private rooms the user is a member of.
+func GetRooms(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetRooms", "controller")
+	defer span.End()
+
+	resp, err := repos.Rooms.GetRoomsVisibleToUser(spanCtx, ctx.Locals("user_id").(uint))
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// JoinRoom handles the HTTP request to join the room identified by the :id parameter.
+// Anyone can join a public room, private rooms can only be entered through an
+// invitation by the owner (see AddRoomMember). Joining a room twice is a no-op.
+func JoinRoom(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "JoinRoom", "controller")
+	defer span.End()
+
+	room, fErr := getRoomFromParams(spanCtx, ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	if room.IsPrivate && room.OwnerID != ctx.Locals("user_id").(uint) {
+		log.Printf("user %v tried to join private room %d", ctx.Locals("username"), room.ID)
+		return response.SendFailureResponse(ctx, fiber.StatusForbidden, "room is private", nil)
+	}
+
+	err := repos.Rooms.InsertRoomMember(spanCtx, &models.RoomMember{RoomID: room.ID, UserID: ctx.Locals("user_id").(uint)})
+	if err != nil {
+		errResponse := fmt.Errorf("failed to insert room member: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return response.SendSuccessResponse(ctx, room)
+}
+
+// LeaveRoom handles the HTTP request to leave the room identified by the :id parameter.
+// The owner cannot leave its own room, since that would leave the room without anyone
+// able to invite members.
+func LeaveRoom(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "LeaveRoom", "controller")
+	defer span.End()
+
+	room, fErr := getRoomFromParams(spanCtx, ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	userID := ctx.Locals("user_id").(uint)
+	if room.OwnerID == userID {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "owner cannot leave the room", nil)
+	}
+
+	err := repos.Rooms.DeleteRoomMember(spanCtx, room.ID, userID)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to delete room member: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return response.SendSuccessResponse(ctx, nil)
+}
+
+// AddRoomMember handles the HTTP request of a room owner to add another user, given
+// by username in the request body, to the room identified by the :id parameter.
+// This is the only way into a private room.
+func AddRoomMember(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "AddRoomMember", "controller")
+	defer span.End()
+
+	room, fErr := getRoomFromParams(spanCtx, ctx)
+	if fErr != nil {
+		return response.SendFailureResponse(ctx, fErr.Code, fErr.Message, nil)
+	}
+
+	if room.OwnerID != ctx.Locals("user_id").(uint) {
+		return response.SendFailureResponse(ctx, fiber.StatusForbidden, "only the room owner can add members", nil)
+	}
+
+	req := new(models.AddRoomMemberRequest)
+	err := ctx.BodyParser(req)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to parse body request: %v", err)
+		log.Println("Failed to parse body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	err = req.Validate()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to validate body request: %v", err)
+		log.Println("Failed to validate body request: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, errResponse.Error(), nil)
+	}
+
+	user, err := repos.Users.GetUserByUsername(spanCtx, req.Username)
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get user by username: %v", err))
+		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "user not found", nil)
+	}
+
+	err = repos.Rooms.InsertRoomMember(spanCtx, &models.RoomMember{RoomID: room.ID, UserID: user.ID})
+	if err != nil {
+		errResponse := fmt.Errorf("failed to insert room member: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	return response.SendSuccessResponse(ctx, nil)
+}
+
+// getRoomFromParams loads the room identified by the :id route parameter. It returns
+// a fiber.Error carrying the status code and message to respond with when the
+// parameter is invalid, the room does not exist or the lookup fails.
+func getRoomFromParams(spanCtx context.Context, ctx *fiber.Ctx) (models.Room, *fiber.Error) {
+	roomID, err := ctx.ParamsInt("id")
+	if err != nil || roomID <= 0 {
+		return models.Room{}, fiber.NewError(fiber.StatusBadRequest, "invalid room id")
+	}
+
+	room, err := repos.Rooms.GetRoomByID(spanCtx, uint(roomID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return room, fiber.NewError(fiber.StatusNotFound, "room not found")
+	}
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get room: %v", err))
+		return room, fiber.NewError(fiber.StatusInternalServerError, "internal server error")
+	}
+	return room, nil
+}
@@ -1,17 +1,30 @@
 package controllers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/kooroshh/fiber-boostrap/app/models"
-	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
 	"github.com/kooroshh/fiber-boostrap/pkg/jwt_token"
 	"github.com/kooroshh/fiber-boostrap/pkg/response"
 	"go.elastic.co/apm"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	maxPresenceUsernames = 100
+	maxUserAgentLength   = 255
 )
 
 // Register handles the HTTP request to register a new user.
@@ -46,8 +59,9 @@ func Register(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, errResponse.Error(), nil)
 	}
 	user.Password = string(hashPassword)
+	user.Role = models.RoleUser
 
-	err = repository.InsertNewUser(spanCtx, user)
+	err = repos.Users.InsertNewUser(spanCtx, user)
 	if err != nil {
 		errResponse := fmt.Errorf("failed to insert new user: %v", err)
 		log.Println(errResponse)
@@ -61,9 +75,16 @@ func Register(ctx *fiber.Ctx) error {
 }
 
 // Login handles user authentication by validating credentials provided in the HTTP request.
-// It parses the login request, validates the user credentials, and retrieves the user from the database.
+// It parses the login request, refuses it while the username or the IP address is
+// blocked after too many failed logins, see LoginThrottleConfig, and answers with 423
+// Locked or 429 Too Many Requests and a Retry-After header. Otherwise the attempt is
+// counted as failed before the user credentials are validated; attempts for usernames
+// that do not exist only count for the IP address. A successful login resets the count
+// of the username and takes the attempt back from the count of the IP address.
 // If the credentials are correct, it generates a JWT token and a refresh token.
-// It then creates a new user session in the database with these tokens.
+// It then creates a new user session in the database with these tokens and the user agent
+// and IP address of the request, starting a new session family that the tokens issued by
+// later refreshes belong to.
 // Finally, it returns a success response with the generated tokens or a failure response in case of any errors.
 func Login(ctx *fiber.Ctx) error {
 	span, spanCtx := apm.StartSpan(ctx.Context(), "Login", "controller")
@@ -89,10 +110,34 @@ func Login(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, errResponse.Error(), nil)
 	}
 
-	user, err := repository.GetUserByUsername(spanCtx, loginReq.Username)
-	if err != nil {
+	user, err := repos.Users.GetUserByUsername(spanCtx, loginReq.Username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		errResponse := fmt.Errorf("failed to get user by username: %v", err)
 		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	userExists := err == nil
+
+	// The attempt is counted as failed before the password is checked, so that a burst
+	// of concurrent attempts cannot all get past the throttle. Usernames that do not
+	// exist have no counter, the IP address throttles guessing them.
+	ipCounter := ipLoginCounter(ctx.IP())
+	counters := []loginCounter{ipCounter}
+	if userExists {
+		counters = []loginCounter{userLoginCounter(user.Username), ipCounter}
+	}
+	throttles, blocking, err := reserveLoginAttempt(spanCtx, counters, now)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	if blocking != nil {
+		log.Printf("login of %s from %s blocked until %s", loginReq.Username, ctx.IP(), blocking.BlockedUntil)
+		return sendLoginBlocked(ctx, *blocking, now)
+	}
+
+	if !userExists {
+		log.Printf("login of unknown user %s from %s", loginReq.Username, ctx.IP())
 		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "username/password is wrong", nil)
 	}
 
@@ -100,9 +145,16 @@ func Login(ctx *fiber.Ctx) error {
 	if err != nil {
 		errResponse := fmt.Errorf("failed to compare hash password: %v", err)
 		log.Println(errResponse)
+		recordLoginLockout(ctx, spanCtx, user, throttles[0])
 		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "username/password is wrong", nil)
 	}
 
+	err = repos.LoginThrottles.DeleteLoginThrottle(spanCtx, loginUserKey(user.Username))
+	if err != nil {
+		log.Println("failed to reset failed logins: ", err)
+	}
+	releaseLoginAttempt(spanCtx, []loginCounter{ipCounter})
+
 	token, err := jwt_token.GenerateToken(spanCtx, user.Username, user.FullName, "token", now)
 	if err != nil {
 		errResponse := fmt.Errorf("failed to generate token: %v", err)
@@ -117,14 +169,25 @@ func Login(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
 	}
 
+	familyID, err := newFamilyID()
+	if err != nil {
+		errResponse := fmt.Errorf("failed to generate session family: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
 	userSession := &models.UserSession{
 		UserID:              user.ID,
-		Token:               token,
-		RefreshToken:        refreshToken,
+		FamilyID:            familyID,
+		TokenHash:           models.HashToken(token),
+		RefreshTokenHash:    models.HashToken(refreshToken),
 		TokenExpired:        now.Add(jwt_token.MapTypeToken["token"]),
 		RefreshTokenExpired: now.Add(jwt_token.MapTypeToken["refresh_token"]),
+		UserAgent:           truncate(ctx.Get(fiber.HeaderUserAgent), maxUserAgentLength),
+		IP:                  ctx.IP(),
+		LastUsedAt:          now,
 	}
-	err = repository.InsertNewUserSession(spanCtx, userSession)
+	err = repos.Sessions.InsertNewUserSession(spanCtx, userSession)
 	if err != nil {
 		errResponse := fmt.Errorf("failed insert user session: %v", err)
 		log.Println(errResponse)
@@ -142,26 +205,106 @@ func Login(ctx *fiber.Ctx) error {
 // Logout handles the HTTP request to log out a user by deleting their session.
 // It retrieves the authorization token from the request header and attempts to
 // delete the corresponding user session from the database. If the deletion is
-// successful, it returns a success response. Otherwise, it returns an error response.
+// successful, the WebSocket connections of the session are closed and it returns a
+// success response. Otherwise, it returns an error response.
 func Logout(ctx *fiber.Ctx) error {
 	span, spanCtx := apm.StartSpan(ctx.Context(), "Logout", "controller")
 	defer span.End()
 
 	token := ctx.Get("Authorization")
-	err := repository.DeleteUserSessionByToken(spanCtx, token)
+	err := repos.Sessions.DeleteUserSessionByToken(spanCtx, token)
 	if err != nil {
 		errResponse := fmt.Errorf("failed delete user session: %v", err)
 		log.Println(errResponse)
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
 	}
+	ws.DefaultHub.DisconnectSessions(ctx.Locals("session_id").(uint))
 	return response.SendSuccessResponse(ctx, nil)
 }
 
-// RefreshToken handles the HTTP request to refresh a user's token.
-// It retrieves the refresh token from the request header and attempts to
-// update the corresponding user session in the database with a new token.
-// If the update is successful, it returns a success response with the new token.
-// Otherwise, it returns an error response.
+// GetSessions handles the HTTP request to list the login sessions of the current user,
+// one per device that logged in and has not logged out, most recently used first. The
+// tokens of the sessions are never returned; the session of the request is marked as
+// current.
+func GetSessions(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetSessions", "controller")
+	defer span.End()
+
+	currentID := ctx.Locals("session_id").(uint)
+	sessions, err := repos.Sessions.GetUserSessionsByUserID(spanCtx, ctx.Locals("user_id").(uint))
+	if err != nil {
+		errResponse := fmt.Errorf("failed to get user sessions: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	resp := make([]models.SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, models.SessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			Current:    session.ID == currentID,
+		})
+	}
+	return response.SendSuccessResponse(ctx, resp)
+}
+
+// RevokeSession handles the HTTP request to log out one of the current user's sessions,
+// given by the id path parameter. Its tokens stop working and its WebSocket connections
+// are closed right away. Sessions of other users are reported as not found.
+func RevokeSession(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "RevokeSession", "controller")
+	defer span.End()
+
+	sessionID, err := strconv.ParseUint(ctx.Params("id"), 10, 64)
+	if err != nil {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "invalid session id", nil)
+	}
+
+	err = repos.Sessions.DeleteUserSessionByID(spanCtx, ctx.Locals("user_id").(uint), uint(sessionID))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "session not found", nil)
+	}
+	if err != nil {
+		errResponse := fmt.Errorf("failed to delete user session: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	ws.DefaultHub.DisconnectSessions(uint(sessionID))
+	return response.SendSuccessResponse(ctx, nil)
+}
+
+// RevokeAllSessions handles the HTTP request to log the current user out everywhere.
+// Every session of the user, including the one of the request, is deleted and their
+// WebSocket connections are closed. The number of revoked sessions is returned.
+func RevokeAllSessions(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "RevokeAllSessions", "controller")
+	defer span.End()
+
+	sessionIDs, err := repos.Sessions.DeleteUserSessionsByUserID(spanCtx, ctx.Locals("user_id").(uint))
+	if err != nil {
+		errResponse := fmt.Errorf("failed to delete user sessions: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	ws.DefaultHub.DisconnectSessions(sessionIDs...)
+	return response.SendSuccessResponse(ctx, fiber.Map{
+		"revoked": len(sessionIDs),
+	})
+}
+
+// RefreshToken handles the HTTP request to refresh a user's tokens.
+// It retrieves the refresh token from the request header and exchanges it for a new
+// token and a new refresh token, retiring the old one. If the rotation is successful,
+// it returns a success response with both tokens. A refresh token that is unknown or
+// expired is rejected with a 401 Unauthorized response. A retired refresh token being
+// presented again means it leaked, so every session of its family is revoked and a
+// security event is recorded before the request is rejected.
 func RefreshToken(ctx *fiber.Ctx) error {
 	span, spanCtx := apm.StartSpan(ctx.Context(), "RefreshToken", "controller")
 	defer span.End()
@@ -171,6 +314,21 @@ func RefreshToken(ctx *fiber.Ctx) error {
 	username := ctx.Locals("username").(string)
 	fullName := ctx.Locals("full_name").(string)
 
+	session, err := repos.Sessions.GetUserSessionByRefreshToken(spanCtx, refreshToken)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return rejectRefreshToken(ctx, spanCtx, refreshToken, username)
+	}
+	if err != nil {
+		errResponse := fmt.Errorf("failed to get user session by refresh token: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	if now.After(session.RefreshTokenExpired) {
+		log.Println("refresh token is expired: ", session.RefreshTokenExpired)
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+
 	token, err := jwt_token.GenerateToken(spanCtx, username, fullName, "token", now)
 	if err != nil {
 		errResponse := fmt.Errorf("failed to generate token: %v", err)
@@ -178,14 +336,198 @@ func RefreshToken(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
 	}
 
-	err = repository.UpdateUserSessionToken(spanCtx, token, now.Add(jwt_token.MapTypeToken["token"]), refreshToken)
+	newRefreshToken, err := jwt_token.GenerateToken(spanCtx, username, fullName, "refresh_token", now)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to generate refresh token: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	// Sessions created before rotation existed have no family yet.
+	if session.FamilyID == "" {
+		session.FamilyID, err = newFamilyID()
+		if err != nil {
+			errResponse := fmt.Errorf("failed to generate session family: %v", err)
+			log.Println(errResponse)
+			return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+		}
+	}
+
+	retired := models.RetiredRefreshToken{
+		UserID:           session.UserID,
+		FamilyID:         session.FamilyID,
+		RefreshTokenHash: models.HashToken(refreshToken),
+		ExpiresAt:        session.RefreshTokenExpired,
+	}
+	session.TokenHash = models.HashToken(token)
+	session.TokenExpired = now.Add(jwt_token.MapTypeToken["token"])
+	session.RefreshTokenHash = models.HashToken(newRefreshToken)
+	session.RefreshTokenExpired = now.Add(jwt_token.MapTypeToken["refresh_token"])
+	session.LastUsedAt = now
+
+	err = repos.Sessions.RotateUserSessionToken(spanCtx, session, retired)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Another request rotated the same refresh token first.
+		return rejectRefreshToken(ctx, spanCtx, refreshToken, username)
+	}
 	if err != nil {
-		errResponse := fmt.Errorf("failed to update token: %v", err)
+		errResponse := fmt.Errorf("failed to rotate token: %v", err)
 		log.Println(errResponse)
 		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
 	}
 
 	return response.SendSuccessResponse(ctx, fiber.Map{
-		"token": token,
+		"token":         token,
+		"refresh_token": newRefreshToken,
 	})
 }
+
+// UnlockUser handles the HTTP request of an admin to lift the lockout and the login
+// backoff of the user given by the username path parameter, so that the user can log
+// in again right away. Blocks of IP addresses are left alone. The unlock is recorded as
+// a security event.
+func UnlockUser(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "UnlockUser", "controller")
+	defer span.End()
+
+	user, err := repos.Users.GetUserByUsername(spanCtx, ctx.Params("username"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return response.SendFailureResponse(ctx, fiber.StatusNotFound, "user not found", nil)
+	}
+	if err != nil {
+		errResponse := fmt.Errorf("failed to get user by username: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	err = repos.LoginThrottles.DeleteLoginThrottle(spanCtx, loginUserKey(user.Username))
+	if err != nil {
+		errResponse := fmt.Errorf("failed to unlock user: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	recordSecurityEvent(ctx, spanCtx, models.SecurityEvent{
+		UserID:   user.ID,
+		Username: user.Username,
+		Event:    models.SecurityEventAccountUnlocked,
+		Detail:   "unlocked by " + ctx.Locals("username").(string),
+	})
+	return response.SendSuccessResponse(ctx, nil)
+}
+
+// rejectRefreshToken answers a refresh with a refresh token that no session holds. When
+// the token was retired by an earlier refresh, its session family is revoked and the
+// reuse is recorded as a security event.
+func rejectRefreshToken(ctx *fiber.Ctx, spanCtx context.Context, refreshToken string, username string) error {
+	retired, err := repos.Sessions.GetRetiredRefreshToken(spanCtx, refreshToken)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Println("refresh token does not belong to a session")
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+	if err != nil {
+		errResponse := fmt.Errorf("failed to get retired refresh token: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	sessionIDs, err := repos.Sessions.DeleteUserSessionsByFamily(spanCtx, retired.FamilyID)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to revoke session family: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+	ws.DefaultHub.DisconnectSessions(sessionIDs...)
+
+	recordSecurityEvent(ctx, spanCtx, models.SecurityEvent{
+		UserID:   retired.UserID,
+		Username: username,
+		Event:    models.SecurityEventRefreshTokenReuse,
+		FamilyID: retired.FamilyID,
+		Detail:   "retired refresh token presented, session family revoked",
+	})
+	return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+}
+
+// recordSecurityEvent logs event and stores it with the address and user agent of the
+// request. Failing to store it does not fail the request.
+func recordSecurityEvent(ctx *fiber.Ctx, spanCtx context.Context, event models.SecurityEvent) {
+	event.IP = ctx.IP()
+	event.UserAgent = ctx.Get(fiber.HeaderUserAgent)
+	log.Printf("security event %s: user=%s family=%s ip=%s: %s", event.Event, event.Username, event.FamilyID, event.IP, event.Detail)
+
+	if err := repos.SecurityEvents.InsertSecurityEvent(spanCtx, &event); err != nil {
+		log.Println("failed to insert security event: ", err)
+	}
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 character. The
+// result is a copy, so it may outlive the request s was read from.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+	}
+	return strings.Clone(s)
+}
+
+// newFamilyID returns a random identifier for a new session family.
+func newFamilyID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// GetPresence handles the HTTP request to retrieve the presence of the users given as a
+// comma separated list in the usernames query parameter. A user is online while it has
+// at least one live WebSocket connection to any instance, otherwise the time its last connection closed
+// is returned as last_seen_at. Unknown usernames are left out of the response.
+func GetPresence(ctx *fiber.Ctx) error {
+	span, spanCtx := apm.StartSpan(ctx.Context(), "GetPresence", "controller")
+	defer span.End()
+
+	var usernames []string
+	for _, username := range strings.Split(ctx.Query("usernames"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	if len(usernames) == 0 {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, "usernames is required", nil)
+	}
+	if len(usernames) > maxPresenceUsernames {
+		return response.SendFailureResponse(ctx, fiber.StatusBadRequest, fmt.Sprintf("at most %d usernames are allowed", maxPresenceUsernames), nil)
+	}
+
+	users, err := repos.Users.GetUsersByUsernames(spanCtx, usernames)
+	if err != nil {
+		errResponse := fmt.Errorf("failed to get users by usernames: %v", err)
+		log.Println(errResponse)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.Username)
+	}
+	online, err := ws.DefaultHub.Online(spanCtx, names)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusInternalServerError, "internal server error", nil)
+	}
+
+	resp := make([]models.PresencePayload, 0, len(users))
+	for _, user := range users {
+		presence := models.PresencePayload{Username: user.Username, Status: models.PresenceOffline, LastSeenAt: user.LastSeenAt}
+		if online[user.Username] {
+			presence.Status = models.PresenceOnline
+		}
+		resp = append(resp, presence)
+	}
+
+	return response.SendSuccessResponse(ctx, resp)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EnvelopeVersion is the current version of the WebSocket envelope. Clients opt in
+// by connecting with ?v=1; connections without a version keep receiving bare
+// MessagePayload objects and can only send them.
+const EnvelopeVersion = 1
+
+// Event types of the WebSocket protocol. message.send, message.edit, message.delete,
+// reaction.add, reaction.remove, typing.start, typing.stop, read and ping are sent by
+// clients, message.new, message.updated, message.deleted, reaction.updated,
+// thread.reply, replay.gap, typing, presence, receipt, error and pong by the server,
+// and ack in both directions to confirm that an event was received; an ack carrying a
+// message_id from a client marks that message delivered.
+const (
+	EventMessageSend     = "message.send"
+	EventMessageNew      = "message.new"
+	EventMessageEdit     = "message.edit"
+	EventMessageDelete   = "message.delete"
+	EventMessageUpdated  = "message.updated"
+	EventMessageDeleted  = "message.deleted"
+	EventReactionAdd     = "reaction.add"
+	EventReactionRemove  = "reaction.remove"
+	EventReactionUpdated = "reaction.updated"
+	EventThreadReply     = "thread.reply"
+	EventReplayGap       = "replay.gap"
+	EventTypingStart     = "typing.start"
+	EventTypingStop      = "typing.stop"
+	EventTyping          = "typing"
+	EventPresence        = "presence"
+	EventAck             = "ack"
+	EventRead            = "read"
+	EventReceipt         = "receipt"
+	EventError           = "error"
+	EventPing            = "ping"
+	EventPong            = "pong"
+)
+
+// Error codes carried by error events.
+const (
+	ErrorCodeBadRequest       = "bad_request"
+	ErrorCodeUnsupportedEvent = "unsupported_event"
+	ErrorCodeForbidden        = "forbidden"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeConflict         = "conflict"
+	ErrorCodeRateLimited      = "rate_limited"
+	ErrorCodeMessageTooLong   = "message_too_long"
+	ErrorCodeInternal         = "internal_error"
+)
+
+// Envelope wraps every event exchanged over the WebSocket. Type tells the receiver how
+// to decode Data, so new kinds of events can be added without breaking clients that
+// ignore the types they do not know. ID is an optional client-chosen identifier that
+// the server echoes as ref in the ack or error answering the event.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// NewEnvelope encodes data as the payload of an event of the given type.
+func NewEnvelope(eventType string, data interface{}) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Version: EnvelopeVersion, Type: eventType, Data: raw}, nil
+}
+
+const (
+	TypingStateStart = "start"
+	TypingStateStop  = "stop"
+)
+
+// TypingPayload is sent by clients in typing.start and typing.stop to name the
+// conversation, and by the server in typing events to tell the other participants
+// who started or stopped typing there.
+type TypingPayload struct {
+	Username string `json:"username,omitempty"`
+	State    string `json:"state,omitempty"`
+	RoomID   uint   `json:"room_id,omitempty"`
+	To       string `json:"to,omitempty"`
+}
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// PresencePayload is sent by the server in presence events whenever a user gets its
+// first connection or loses its last one, and returned by the presence endpoint.
+type PresencePayload struct {
+	Username   string     `json:"username"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// MessageActionPayload is sent by clients in message.edit (with the new text in
+// Message) and message.delete.
+type MessageActionPayload struct {
+	MessageID string `json:"message_id"`
+	Message   string `json:"message,omitempty"`
+}
+
+const (
+	ReactionAdded   = "added"
+	ReactionRemoved = "removed"
+)
+
+// ReactionPayload is sent by clients in reaction.add and reaction.remove, and by the
+// server in reaction.updated with the user who changed the reaction, the action and
+// the resulting count for the emoji.
+type ReactionPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Username  string `json:"username,omitempty"`
+	Action    string `json:"action,omitempty"`
+	Count     int64  `json:"count"`
+}
+
+// ThreadReplyPayload notifies the participants of a thread about a new reply and the
+// updated counters of the thread root.
+type ThreadReplyPayload struct {
+	RootID      string         `json:"root_id"`
+	ReplyCount  int64          `json:"reply_count"`
+	LastReplyAt *time.Time     `json:"last_reply_at"`
+	Message     MessagePayload `json:"message"`
+}
+
+// ReplayGapPayload tells a resuming client that more messages were sent since its
+// last seen message than the server replays. The client has to refetch the history.
+type ReplayGapPayload struct {
+	Since string `json:"since"`
+	Limit int64  `json:"limit"`
+}
+
+type AckPayload struct {
+	Ref       string `json:"ref,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+// ReceiptPayload tells the sender of a message that a recipient got or read it.
+type ReceiptPayload struct {
+	MessageID string    `json:"message_id"`
+	Username  string    `json:"username"`
+	Status    string    `json:"status"`
+	At        time.Time `json:"at"`
+}
+
+type ErrorPayload struct {
+	Ref     string `json:"ref,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
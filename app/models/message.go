@@ -1,9 +1,193 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MessageTypeText = "text"
+)
 
 type MessagePayload struct {
-	From    string    `json:"from"`
-	Message string    `json:"message"`
-	Date    time.Time `json:"date"`
+	ID             primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	ClientMsgID    string              `json:"client_msg_id,omitempty" bson:"client_msg_id,omitempty"`
+	Type           string              `json:"type" bson:"type"`
+	From           string              `json:"from"`
+	Message        string              `json:"message"`
+	Date           time.Time           `json:"date"`
+	RoomID         uint                `json:"room_id,omitempty" bson:"room_id,omitempty"`
+	To             string              `json:"to,omitempty" bson:"to,omitempty"`
+	ConversationID string              `json:"conversation_id,omitempty" bson:"conversation_id,omitempty"`
+	Receipts       []MessageReceipt    `json:"receipts,omitempty" bson:"receipts,omitempty"`
+	EditedAt       *time.Time          `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	Edits          []MessageEdit       `json:"edits,omitempty" bson:"edits,omitempty"`
+	Deleted        bool                `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	DeletedAt      *time.Time          `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	DeletedBy      string              `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
+	Reactions      map[string]Reaction `json:"reactions,omitempty" bson:"reactions,omitempty"`
+
+	// ReplyTo is the message this one answers and ThreadRoot the first message of the
+	// thread both belong to. Only thread roots carry the reply counters.
+	ReplyTo            *primitive.ObjectID `json:"reply_to,omitempty" bson:"reply_to,omitempty"`
+	ThreadRoot         *primitive.ObjectID `json:"thread_root,omitempty" bson:"thread_root,omitempty"`
+	ReplyCount         int64               `json:"reply_count,omitempty" bson:"reply_count,omitempty"`
+	LastReplyAt        *time.Time          `json:"last_reply_at,omitempty" bson:"last_reply_at,omitempty"`
+	ThreadParticipants []string            `json:"thread_participants,omitempty" bson:"thread_participants,omitempty"`
+}
+
+// Reaction aggregates the users who reacted to a message with one emoji. Each user
+// counts at most once per emoji.
+type Reaction struct {
+	Count int64    `json:"count" bson:"count"`
+	Users []string `json:"users" bson:"users"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" validate:"required"`
+}
+
+// Validate checks the fields of the ReactionRequest struct against the defined
+// validation tags and returns an error if any validation rules are violated.
+func (l ReactionRequest) Validate() error {
+	v := validator.New()
+	return v.Struct(l)
+}
+
+// MessageEdit is a previous version of an edited message, replaced by EditedBy at
+// EditedAt. EditedBy differs from the sender when a moderator edited the message.
+type MessageEdit struct {
+	Message  string    `json:"message" bson:"message"`
+	EditedBy string    `json:"edited_by,omitempty" bson:"edited_by,omitempty"`
+	EditedAt time.Time `json:"edited_at" bson:"edited_at"`
+}
+
+type EditMessageRequest struct {
+	Message string `json:"message" validate:"required"`
+}
+
+// Validate checks the fields of the EditMessageRequest struct against the defined
+// validation tags and returns an error if any validation rules are violated.
+func (l EditMessageRequest) Validate() error {
+	v := validator.New()
+	return v.Struct(l)
+}
+
+// ConversationKey identifies the conversation the message belongs to: "room:<id>" for
+// room messages, the direct conversation ID for direct messages and "global" for the
+// global channel.
+func (m MessagePayload) ConversationKey() string {
+	switch {
+	case m.RoomID != 0:
+		return fmt.Sprintf("room:%d", m.RoomID)
+	case m.ConversationID != "":
+		return m.ConversationID
+	default:
+		return GlobalConversationKey
+	}
+}
+
+const GlobalConversationKey = "global"
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// MessageReceipt is the delivery state of a message for one recipient. A message
+// that was read is always delivered as well.
+type MessageReceipt struct {
+	Username    string     `json:"username" bson:"username"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty" bson:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty" bson:"read_at,omitempty"`
+}
+
+// ReadMarker is the newest message a user has read in a conversation. Every later
+// message of the conversation that the user did not send counts as unread.
+type ReadMarker struct {
+	Username     string             `json:"-" bson:"username"`
+	Conversation string             `json:"conversation" bson:"conversation"`
+	MessageID    primitive.ObjectID `json:"message_id" bson:"message_id"`
+	MessageDate  time.Time          `json:"message_date" bson:"message_date"`
+	UpdatedAt    time.Time          `json:"updated_at" bson:"updated_at"`
+	UnreadCount  int64              `json:"unread_count" bson:"-"`
+}
+
+type ReadMarkerRequest struct {
+	MessageID string `json:"message_id" validate:"required,len=24,hexadecimal"`
+}
+
+// Validate checks the fields of the ReadMarkerRequest struct against the defined
+// validation tags and returns an error if any validation rules are violated.
+func (l ReadMarkerRequest) Validate() error {
+	v := validator.New()
+	return v.Struct(l)
+}
+
+// HistoryCursor is a position in the message history, the date and ID of a message.
+// Messages are ordered by date and then by ID, so that messages sent within the same
+// millisecond are neither skipped nor repeated between pages. A cursor without an ID
+// only compares dates.
+type HistoryCursor struct {
+	Date time.Time
+	ID   primitive.ObjectID
+}
+
+// IsZero reports whether the cursor is unset.
+func (c HistoryCursor) IsZero() bool {
+	return c.Date.IsZero()
+}
+
+// MessageHistoryQuery selects a page of message history. Before and After are
+// exclusive bounds, a zero value means unbounded. Pages are read backwards from
+// Before unless After is set, in which case they are read forwards from After.
+type MessageHistoryQuery struct {
+	Before HistoryCursor
+	After  HistoryCursor
+	Limit  int64
+}
+
+type MessageHistoryResponse struct {
+	Root       *MessagePayload  `json:"root,omitempty"`
+	Messages   []MessagePayload `json:"messages"`
+	NextCursor string           `json:"next_cursor"`
+}
+
+// Orders of the message search results.
+const (
+	SearchSortRelevance = "relevance"
+	SearchSortDate      = "date"
+)
+
+// MessageSearchQuery selects a page of the messages matching a full-text search. From,
+// RoomID, Since and Until are optional filters, a zero value means unfiltered. Since
+// and Until are inclusive bounds on the message date. Pages are addressed by Offset
+// since relevance ordering has no stable cursor.
+type MessageSearchQuery struct {
+	Text   string
+	From   string
+	RoomID uint
+	Since  time.Time
+	Until  time.Time
+	Sort   string
+	Offset int64
+	Limit  int64
+}
+
+type MessageSearchResponse struct {
+	Messages   []MessagePayload `json:"messages"`
+	NextCursor string           `json:"next_cursor"`
+}
+
+// DirectConversationID returns the key of the one-to-one conversation between two
+// users. The key does not depend on the order of the arguments, so both participants
+// resolve to the same conversation.
+func DirectConversationID(userID uint, otherUserID uint) string {
+	if userID > otherUserID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return fmt.Sprintf("dm:%d:%d", userID, otherUserID)
 }
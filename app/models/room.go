@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type Room struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+	Name      string    `json:"name" gorm:"type:varchar(100);" validate:"required,min=3,max=100"`
+	Topic     string    `json:"topic" gorm:"type:varchar(255);" validate:"max=255"`
+	IsPrivate bool      `json:"is_private"`
+	OwnerID   uint      `json:"owner_id" gorm:"type:int"`
+}
+
+// Validate checks the fields of the Room struct against the defined validation tags
+// and returns an error if any validation rules are violated.
+func (l Room) Validate() error {
+	v := validator.New()
+	return v.Struct(l)
+}
+
+type RoomMember struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	RoomID    uint `json:"room_id" gorm:"type:int;uniqueIndex:idx_room_member"`
+	UserID    uint `json:"user_id" gorm:"type:int;uniqueIndex:idx_room_member"`
+}
+
+type AddRoomMemberRequest struct {
+	Username string `json:"username" validate:"required"`
+}
+
+// Validate checks the fields of the AddRoomMemberRequest struct against the defined
+// validation tags and returns an error if any validation rules are violated.
+func (l AddRoomMemberRequest) Validate() error {
+	v := validator.New()
+	return v.Struct(l)
+}
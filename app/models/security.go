@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+const (
+	SecurityEventRefreshTokenReuse = "refresh_token_reuse"
+	SecurityEventAccountLocked     = "account_locked"
+	SecurityEventAccountUnlocked   = "account_unlocked"
+)
+
+// SecurityEvent records something that happened to an account and may need a closer
+// look, such as a retired refresh token being presented again.
+type SecurityEvent struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uint      `json:"user_id" gorm:"type:int;index"`
+	Username  string    `json:"username" gorm:"type:varchar(32);index"`
+	Event     string    `json:"event" gorm:"type:varchar(50);index"`
+	FamilyID  string    `json:"family_id,omitempty" gorm:"type:varchar(64)"`
+	IP        string    `json:"ip,omitempty" gorm:"type:varchar(64)"`
+	UserAgent string    `json:"user_agent,omitempty" gorm:"type:varchar(255)"`
+	Detail    string    `json:"detail,omitempty" gorm:"type:varchar(255)"`
+}
+
+// LoginThrottle counts the recent failed logins of a username or of an IP address,
+// told apart by the prefix of Key. Logins for it are refused until BlockedUntil; Locked
+// marks an account lockout rather than a backoff delay.
+type LoginThrottle struct {
+	ID            uint      `json:"-" gorm:"primarykey"`
+	Key           string    `json:"key" gorm:"column:throttle_key;type:varchar(100);uniqueIndex"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at" gorm:"index"`
+	BlockedUntil  time.Time `json:"blocked_until"`
+	Locked        bool      `json:"locked"`
+}
@@ -1,20 +1,30 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 )
 
 type User struct {
-	ID        uint      `gorm:"primarykey"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
-	Username  string    `json:"username" gorm:"unique;type:varchar(20);" validate:"required,min=6,max=32"`
-	Password  string    `json:"password,omitempty" gorm:"type:varchar(255);" validate:"required,min=6"`
-	FullName  string    `json:"full_name" gorm:"type:varchar(100);" validate:"required,min=6"`
+	ID         uint       `gorm:"primarykey"`
+	CreatedAt  time.Time  `json:"-"`
+	UpdatedAt  time.Time  `json:"-"`
+	Username   string     `json:"username" gorm:"unique;type:varchar(20);" validate:"required,min=6,max=32"`
+	Password   string     `json:"password,omitempty" gorm:"type:varchar(255);" validate:"required,min=6"`
+	FullName   string     `json:"full_name" gorm:"type:varchar(100);" validate:"required,min=6"`
+	Role       string     `json:"role" gorm:"type:varchar(20);default:user"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 // Validate checks the fields of the User struct against the defined validation tags
 // and returns an error if any validation rules are violated.
 func (l User) Validate() error {
@@ -22,15 +32,24 @@ func (l User) Validate() error {
 	return v.Struct(l)
 }
 
+// UserSession is created on login. Every refresh replaces its token and refresh token;
+// FamilyID stays the same across refreshes and ties the retired refresh tokens of the
+// session to it. UserAgent and IP describe the device that logged in, LastUsedAt is
+// updated as the session is used. The tokens are only stored as their hashes, see
+// HashToken.
 type UserSession struct {
 	ID                  uint `gorm:"primarykey"`
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 	UserID              uint      `json:"user_id" gorm:"type:int" validate:"required"`
-	Token               string    `json:"token" gorm:"type:varchar(255)" validate:"required"`
-	RefreshToken        string    `json:"refresh_token" gorm:"type:varchar(255)" validate:"required"`
+	FamilyID            string    `json:"-" gorm:"type:varchar(64);index"`
+	TokenHash           string    `json:"-" gorm:"type:char(64);index" validate:"required"`
+	RefreshTokenHash    string    `json:"-" gorm:"type:char(64);index" validate:"required"`
 	TokenExpired        time.Time `json:"-" validate:"required"`
 	RefreshTokenExpired time.Time `json:"-" validate:"required"`
+	UserAgent           string    `json:"user_agent" gorm:"type:varchar(255)"`
+	IP                  string    `json:"ip" gorm:"type:varchar(64)"`
+	LastUsedAt          time.Time `json:"last_used_at"`
 }
 
 // Validate checks the fields of the UserSession struct against the defined validation tags
@@ -40,8 +59,39 @@ func (l UserSession) Validate() error {
 	return v.Struct(l)
 }
 
+// SessionResponse describes a login session to its owner, without its tokens. Current
+// marks the session the request was made with.
+type SessionResponse struct {
+	ID         uint      `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+// RetiredRefreshToken is a refresh token that was replaced by a refresh. Presenting it
+// again means it was stolen, or the legitimate client lost the race against a thief,
+// and revokes the session family. It is kept until it would have expired.
+type RetiredRefreshToken struct {
+	ID               uint `gorm:"primarykey"`
+	CreatedAt        time.Time
+	UserID           uint      `gorm:"type:int"`
+	FamilyID         string    `gorm:"type:varchar(64);index"`
+	RefreshTokenHash string    `gorm:"type:char(64);index"`
+	ExpiresAt        time.Time `gorm:"index"`
+}
+
+// HashToken returns the hex-encoded SHA-256 hash of a token, which is what sessions
+// store and are looked up by. Tokens carrying an ID or signed with RSA are longer
+// than an indexed column can hold, and a leaked table reveals no usable token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 type LoginRequest struct {
-	Username string `json:"username" validate:"required"`
+	Username string `json:"username" validate:"required,max=32"`
 	Password string `json:"password" validate:"required"`
 }
 
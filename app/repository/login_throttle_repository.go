@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type loginThrottleRepository struct {
+	db *gorm.DB
+}
+
+// NewLoginThrottleRepository returns a LoginThrottleRepository storing the failed login
+// counters in db, so that every instance of the application shares them.
+func NewLoginThrottleRepository(db *gorm.DB) LoginThrottleRepository {
+	return &loginThrottleRepository{db: db}
+}
+
+func (r *loginThrottleRepository) ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, block LoginBlockFunc) (models.LoginThrottle, bool, error) {
+	span, _ := apm.StartSpan(ctx, "ReserveLoginAttempt", "repository")
+	defer span.End()
+
+	var (
+		resp     models.LoginThrottle
+		reserved bool
+	)
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Concurrent first attempts must not both insert the counter.
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.LoginThrottle{Key: key, LastFailureAt: now}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("throttle_key = ?", key).First(&resp).Error
+		if err != nil {
+			return err
+		}
+
+		if reserved = reserveAttempt(&resp, now, window, block); !reserved {
+			return nil
+		}
+		return saveThrottle(tx, resp)
+	})
+	return resp, reserved, err
+}
+
+func (r *loginThrottleRepository) ReleaseLoginAttempt(ctx context.Context, key string, block LoginBlockFunc) error {
+	span, _ := apm.StartSpan(ctx, "ReleaseLoginAttempt", "repository")
+	defer span.End()
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var throttle models.LoginThrottle
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("throttle_key = ?", key).First(&throttle).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		releaseAttempt(&throttle, block)
+		return saveThrottle(tx, throttle)
+	})
+}
+
+func saveThrottle(tx *gorm.DB, throttle models.LoginThrottle) error {
+	return tx.Model(&throttle).Updates(map[string]interface{}{
+		"failures":        throttle.Failures,
+		"last_failure_at": throttle.LastFailureAt,
+		"blocked_until":   throttle.BlockedUntil,
+		"locked":          throttle.Locked,
+	}).Error
+}
+
+// reserveAttempt counts an attempt at now on throttle and blocks it as if the attempt
+// failed, unless it is blocked at now. It reports whether the attempt was counted.
+func reserveAttempt(throttle *models.LoginThrottle, now time.Time, window time.Duration, block LoginBlockFunc) bool {
+	if throttle.BlockedUntil.After(now) {
+		return false
+	}
+	incrementFailures(throttle, now, window)
+	applyBlock(throttle, block)
+	return true
+}
+
+// releaseAttempt takes back an attempt counted by reserveAttempt.
+func releaseAttempt(throttle *models.LoginThrottle, block LoginBlockFunc) {
+	if throttle.Failures > 0 {
+		throttle.Failures--
+	}
+	applyBlock(throttle, block)
+}
+
+// incrementFailures counts a failed login at now, starting over when the previous
+// failures are older than window.
+func incrementFailures(throttle *models.LoginThrottle, now time.Time, window time.Duration) {
+	if now.Sub(throttle.LastFailureAt) > window {
+		throttle.Failures = 0
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+}
+
+// applyBlock blocks logins as block returns for the failures of throttle, starting at
+// its last failure.
+func applyBlock(throttle *models.LoginThrottle, block LoginBlockFunc) {
+	delay, locked := block(throttle.Failures)
+	throttle.BlockedUntil = throttle.LastFailureAt.Add(delay)
+	throttle.Locked = locked && delay > 0
+}
+
+func (r *loginThrottleRepository) DeleteLoginThrottle(ctx context.Context, key string) error {
+	span, _ := apm.StartSpan(ctx, "DeleteLoginThrottle", "repository")
+	defer span.End()
+
+	return r.db.Exec("DELETE FROM login_throttles WHERE throttle_key = ?", key).Error
+}
+
+func (r *loginThrottleRepository) DeleteForgottenLoginThrottles(ctx context.Context, before time.Time, now time.Time, limit int) (int64, error) {
+	span, _ := apm.StartSpan(ctx, "DeleteForgottenLoginThrottles", "repository")
+	defer span.End()
+
+	res := r.db.Exec("DELETE FROM login_throttles WHERE last_failure_at < ? AND blocked_until <= ? LIMIT ?", before, now, limit)
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,850 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// NewMemoryRepositories returns repositories keeping everything in memory, for tests
+// and local development without MySQL and MongoDB. Nothing survives a restart.
+func NewMemoryRepositories() Repositories {
+	users := &memoryUserRepository{users: make(map[uint]models.User)}
+	return Repositories{
+		Users:          users,
+		Sessions:       &memorySessionRepository{},
+		SecurityEvents: &memorySecurityEventRepository{},
+		LoginThrottles: &memoryLoginThrottleRepository{throttles: make(map[string]models.LoginThrottle)},
+		Rooms:          &memoryRoomRepository{users: users, rooms: make(map[uint]models.Room), members: make(map[uint]map[uint]bool)},
+		Messages:       &memoryMessageRepository{messages: make(map[primitive.ObjectID]models.MessagePayload), readMarkers: make(map[string]models.ReadMarker)},
+	}
+}
+
+type memoryUserRepository struct {
+	mu     sync.RWMutex
+	users  map[uint]models.User
+	nextID uint
+}
+
+func (r *memoryUserRepository) InsertNewUser(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.users {
+		if existing.Username == user.Username {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	r.nextID++
+	user.ID = r.nextID
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	if user.Role == "" {
+		user.Role = models.RoleUser
+	}
+	r.users[user.ID] = *user
+	return nil
+}
+
+func (r *memoryUserRepository) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return models.User{}, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) GetUsersByUsernames(ctx context.Context, usernames []string) ([]models.User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		wanted[username] = true
+	}
+	var resp []models.User
+	for _, user := range r.users {
+		if wanted[user.Username] {
+			resp = append(resp, user)
+		}
+	}
+	return resp, nil
+}
+
+func (r *memoryUserRepository) UpdateUserLastSeen(ctx context.Context, userID uint, lastSeenAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.users[userID]; ok {
+		user.LastSeenAt = &lastSeenAt
+		r.users[userID] = user
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) username(userID uint) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[userID]
+	return user.Username, ok
+}
+
+type memorySessionRepository struct {
+	mu       sync.RWMutex
+	sessions []models.UserSession
+	retired  []models.RetiredRefreshToken
+	nextID   uint
+}
+
+func (r *memorySessionRepository) InsertNewUserSession(ctx context.Context, session *models.UserSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	session.ID = r.nextID
+	session.CreatedAt = time.Now()
+	session.UpdatedAt = session.CreatedAt
+	r.sessions = append(r.sessions, *session)
+	return nil
+}
+
+func (r *memorySessionRepository) GetUserSessionByToken(ctx context.Context, token string) (models.UserSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hash := models.HashToken(token)
+	for i := len(r.sessions) - 1; i >= 0; i-- {
+		if r.sessions[i].TokenHash == hash {
+			return r.sessions[i], nil
+		}
+	}
+	return models.UserSession{}, gorm.ErrRecordNotFound
+}
+
+func (r *memorySessionRepository) DeleteUserSessionByToken(ctx context.Context, token string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash := models.HashToken(token)
+	kept := r.sessions[:0]
+	for _, session := range r.sessions {
+		if session.TokenHash != hash {
+			kept = append(kept, session)
+		}
+	}
+	r.sessions = kept
+	return nil
+}
+
+func (r *memorySessionRepository) GetUserSessionByRefreshToken(ctx context.Context, refreshToken string) (models.UserSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hash := models.HashToken(refreshToken)
+	for i := len(r.sessions) - 1; i >= 0; i-- {
+		if r.sessions[i].RefreshTokenHash == hash {
+			return r.sessions[i], nil
+		}
+	}
+	return models.UserSession{}, gorm.ErrRecordNotFound
+}
+
+func (r *memorySessionRepository) RotateUserSessionToken(ctx context.Context, session models.UserSession, retired models.RetiredRefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.sessions {
+		current := &r.sessions[i]
+		if current.ID != session.ID || current.RefreshTokenHash != retired.RefreshTokenHash {
+			continue
+		}
+		current.FamilyID = session.FamilyID
+		current.TokenHash = session.TokenHash
+		current.TokenExpired = session.TokenExpired
+		current.RefreshTokenHash = session.RefreshTokenHash
+		current.RefreshTokenExpired = session.RefreshTokenExpired
+		current.LastUsedAt = session.LastUsedAt
+		current.UpdatedAt = time.Now()
+
+		now := time.Now()
+		kept := r.retired[:0]
+		for _, token := range r.retired {
+			if !token.ExpiresAt.Before(now) {
+				kept = append(kept, token)
+			}
+		}
+		retired.CreatedAt = now
+		r.retired = append(kept, retired)
+		return nil
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (r *memorySessionRepository) GetRetiredRefreshToken(ctx context.Context, refreshToken string) (models.RetiredRefreshToken, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hash := models.HashToken(refreshToken)
+	for i := len(r.retired) - 1; i >= 0; i-- {
+		if r.retired[i].RefreshTokenHash == hash {
+			return r.retired[i], nil
+		}
+	}
+	return models.RetiredRefreshToken{}, gorm.ErrRecordNotFound
+}
+
+func (r *memorySessionRepository) GetUserSessionsByUserID(ctx context.Context, userID uint) ([]models.UserSession, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	var resp []models.UserSession
+	for _, session := range r.sessions {
+		if session.UserID == userID && session.RefreshTokenExpired.After(now) {
+			resp = append(resp, session)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if !resp[i].LastUsedAt.Equal(resp[j].LastUsedAt) {
+			return resp[i].LastUsedAt.After(resp[j].LastUsedAt)
+		}
+		return resp[i].ID > resp[j].ID
+	})
+	return resp, nil
+}
+
+func (r *memorySessionRepository) UpdateUserSessionLastUsed(ctx context.Context, sessionID uint, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.sessions {
+		if r.sessions[i].ID == sessionID {
+			r.sessions[i].LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+func (r *memorySessionRepository) DeleteUserSessionByID(ctx context.Context, userID uint, sessionID uint) error {
+	ids := r.deleteSessions(func(session models.UserSession) bool {
+		return session.ID == sessionID && session.UserID == userID
+	})
+	if len(ids) == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *memorySessionRepository) DeleteUserSessionsByUserID(ctx context.Context, userID uint) ([]uint, error) {
+	return r.deleteSessions(func(session models.UserSession) bool {
+		return session.UserID == userID
+	}), nil
+}
+
+func (r *memorySessionRepository) DeleteUserSessionsByFamily(ctx context.Context, familyID string) ([]uint, error) {
+	return r.deleteSessions(func(session models.UserSession) bool {
+		return session.FamilyID == familyID
+	}), nil
+}
+
+// deleteSessions deletes the sessions matching the predicate and returns their IDs.
+func (r *memorySessionRepository) deleteSessions(match func(models.UserSession) bool) []uint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []uint
+	kept := r.sessions[:0]
+	for _, session := range r.sessions {
+		if match(session) {
+			ids = append(ids, session.ID)
+			continue
+		}
+		kept = append(kept, session)
+	}
+	r.sessions = kept
+	return ids
+}
+
+type memorySecurityEventRepository struct {
+	mu     sync.Mutex
+	events []models.SecurityEvent
+	nextID uint
+}
+
+func (r *memorySecurityEventRepository) InsertSecurityEvent(ctx context.Context, event *models.SecurityEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	event.ID = r.nextID
+	event.CreatedAt = time.Now()
+	r.events = append(r.events, *event)
+	return nil
+}
+
+type memoryLoginThrottleRepository struct {
+	mu        sync.Mutex
+	throttles map[string]models.LoginThrottle
+	nextID    uint
+}
+
+func (r *memoryLoginThrottleRepository) ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, block LoginBlockFunc) (models.LoginThrottle, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	throttle, ok := r.throttles[key]
+	if !ok {
+		r.nextID++
+		throttle = models.LoginThrottle{ID: r.nextID, Key: key, LastFailureAt: now}
+	}
+	if !reserveAttempt(&throttle, now, window, block) {
+		return throttle, false, nil
+	}
+	r.throttles[key] = throttle
+	return throttle, true, nil
+}
+
+func (r *memoryLoginThrottleRepository) ReleaseLoginAttempt(ctx context.Context, key string, block LoginBlockFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if throttle, ok := r.throttles[key]; ok {
+		releaseAttempt(&throttle, block)
+		r.throttles[key] = throttle
+	}
+	return nil
+}
+
+func (r *memoryLoginThrottleRepository) DeleteLoginThrottle(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.throttles, key)
+	return nil
+}
+
+func (r *memoryLoginThrottleRepository) DeleteForgottenLoginThrottles(ctx context.Context, before time.Time, now time.Time, limit int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deleted int64
+	for key, throttle := range r.throttles {
+		if deleted >= int64(limit) {
+			break
+		}
+		if throttle.LastFailureAt.Before(before) && !throttle.BlockedUntil.After(now) {
+			delete(r.throttles, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memoryRoomRepository struct {
+	mu      sync.RWMutex
+	users   *memoryUserRepository
+	rooms   map[uint]models.Room
+	members map[uint]map[uint]bool
+	nextID  uint
+}
+
+func (r *memoryRoomRepository) InsertNewRoom(ctx context.Context, room *models.Room) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	room.ID = r.nextID
+	room.CreatedAt = time.Now()
+	room.UpdatedAt = room.CreatedAt
+	r.rooms[room.ID] = *room
+	r.members[room.ID] = map[uint]bool{room.OwnerID: true}
+	return nil
+}
+
+func (r *memoryRoomRepository) GetRoomByID(ctx context.Context, roomID uint) (models.Room, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room, ok := r.rooms[roomID]
+	if !ok {
+		return room, gorm.ErrRecordNotFound
+	}
+	return room, nil
+}
+
+func (r *memoryRoomRepository) GetRoomsVisibleToUser(ctx context.Context, userID uint) ([]models.Room, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var resp []models.Room
+	for _, room := range r.rooms {
+		if !room.IsPrivate || r.members[room.ID][userID] {
+			resp = append(resp, room)
+		}
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].ID < resp[j].ID })
+	return resp, nil
+}
+
+func (r *memoryRoomRepository) InsertRoomMember(ctx context.Context, member *models.RoomMember) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[member.RoomID]; !ok {
+		return fmt.Errorf("room %d does not exist", member.RoomID)
+	}
+	r.members[member.RoomID][member.UserID] = true
+	return nil
+}
+
+func (r *memoryRoomRepository) DeleteRoomMember(ctx context.Context, roomID uint, userID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.members[roomID], userID)
+	return nil
+}
+
+func (r *memoryRoomRepository) IsRoomMember(ctx context.Context, roomID uint, userID uint) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.members[roomID][userID], nil
+}
+
+func (r *memoryRoomRepository) GetRoomMemberUsernames(ctx context.Context, roomID uint) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var resp []string
+	for userID := range r.members[roomID] {
+		if username, ok := r.users.username(userID); ok {
+			resp = append(resp, username)
+		}
+	}
+	return resp, nil
+}
+
+func (r *memoryRoomRepository) GetRoomIDsOfMember(ctx context.Context, userID uint) ([]uint, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var resp []uint
+	for roomID, members := range r.members {
+		if members[userID] {
+			resp = append(resp, roomID)
+		}
+	}
+	return resp, nil
+}
+
+// memoryMessageRepository mirrors the semantics of the MongoDB implementation. Stored
+// messages are never handed out directly, callers always get a copy.
+type memoryMessageRepository struct {
+	mu          sync.RWMutex
+	messages    map[primitive.ObjectID]models.MessagePayload
+	readMarkers map[string]models.ReadMarker
+}
+
+func (r *memoryMessageRepository) InsertNewMessage(ctx context.Context, data models.MessagePayload) (models.MessagePayload, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if data.ClientMsgID != "" {
+		for _, msg := range r.messages {
+			if msg.From == data.From && msg.ClientMsgID == data.ClientMsgID {
+				return cloneMessage(msg), true, nil
+			}
+		}
+	}
+	data.ID = primitive.NewObjectID()
+	r.messages[data.ID] = cloneMessage(data)
+	return data, false, nil
+}
+
+func (r *memoryMessageRepository) GetAllMessage(ctx context.Context, roomID uint, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	return r.findMessages(func(msg models.MessagePayload) bool {
+		return inConversation(msg, roomID, "") && msg.ThreadRoot == nil
+	}, query), nil
+}
+
+func (r *memoryMessageRepository) GetDirectMessages(ctx context.Context, conversationID string, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	return r.findMessages(func(msg models.MessagePayload) bool {
+		return inConversation(msg, 0, conversationID) && msg.ThreadRoot == nil
+	}, query), nil
+}
+
+func (r *memoryMessageRepository) GetThreadMessages(ctx context.Context, rootID primitive.ObjectID, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	return r.findMessages(func(msg models.MessagePayload) bool {
+		return msg.ThreadRoot != nil && *msg.ThreadRoot == rootID
+	}, query), nil
+}
+
+func (r *memoryMessageRepository) GetMessagesSince(ctx context.Context, username string, roomIDs []uint, since models.HistoryCursor, limit int64) ([]models.MessagePayload, error) {
+	resp := r.filter(func(msg models.MessagePayload) bool {
+		return compareCursor(msg, since) > 0 && !msg.Deleted && accessibleTo(msg, username, roomIDs)
+	})
+	sortMessages(resp, false)
+	if int64(len(resp)) > limit {
+		resp = resp[:limit]
+	}
+	return resp, nil
+}
+
+// SearchMessages matches messages containing any of the words of query.Text, ignoring
+// case, and scores them by the number of matching words. Unlike the MongoDB text
+// index it does not stem words or support phrases and negations.
+func (r *memoryMessageRepository) SearchMessages(ctx context.Context, query models.MessageSearchQuery, username string, roomIDs []uint) ([]models.MessagePayload, error) {
+	terms := strings.Fields(strings.ToLower(query.Text))
+	scores := make(map[primitive.ObjectID]int)
+
+	resp := r.filter(func(msg models.MessagePayload) bool {
+		if msg.Deleted || !accessibleTo(msg, username, roomIDs) ||
+			(query.From != "" && msg.From != query.From) ||
+			(query.RoomID != 0 && msg.RoomID != query.RoomID) ||
+			(!query.Since.IsZero() && msg.Date.Before(query.Since)) ||
+			(!query.Until.IsZero() && msg.Date.After(query.Until)) {
+			return false
+		}
+
+		text := strings.ToLower(msg.Message)
+		for _, term := range terms {
+			scores[msg.ID] += strings.Count(text, term)
+		}
+		return scores[msg.ID] > 0
+	})
+
+	sortMessages(resp, true)
+	if query.Sort != models.SearchSortDate {
+		sort.SliceStable(resp, func(i, j int) bool { return scores[resp[i].ID] > scores[resp[j].ID] })
+	}
+
+	if query.Offset >= int64(len(resp)) {
+		return nil, nil
+	}
+	resp = resp[query.Offset:]
+	if int64(len(resp)) > query.Limit {
+		resp = resp[:query.Limit]
+	}
+	return resp, nil
+}
+
+func (r *memoryMessageRepository) GetMessageByID(ctx context.Context, messageID primitive.ObjectID) (models.MessagePayload, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return models.MessagePayload{}, mongo.ErrNoDocuments
+	}
+	return cloneMessage(msg), nil
+}
+
+func (r *memoryMessageRepository) UpdateThreadRoot(ctx context.Context, rootID primitive.ObjectID, username string, at time.Time) (models.MessagePayload, error) {
+	return r.update(rootID, func(msg *models.MessagePayload) bool {
+		msg.ReplyCount++
+		if msg.LastReplyAt == nil || at.After(*msg.LastReplyAt) {
+			msg.LastReplyAt = &at
+		}
+		for _, participant := range msg.ThreadParticipants {
+			if participant == username {
+				return true
+			}
+		}
+		msg.ThreadParticipants = append(msg.ThreadParticipants, username)
+		return true
+	})
+}
+
+func (r *memoryMessageRepository) UpdateMessageText(ctx context.Context, messageID primitive.ObjectID, previous string, message string, editedBy string, at time.Time) (models.MessagePayload, error) {
+	return r.update(messageID, func(msg *models.MessagePayload) bool {
+		if msg.Deleted || msg.Message != previous {
+			return false
+		}
+		msg.Edits = append(msg.Edits, models.MessageEdit{Message: previous, EditedBy: editedBy, EditedAt: at})
+		msg.Message = message
+		msg.EditedAt = &at
+		return true
+	})
+}
+
+func (r *memoryMessageRepository) SoftDeleteMessage(ctx context.Context, messageID primitive.ObjectID, deletedBy string, at time.Time) (models.MessagePayload, error) {
+	return r.update(messageID, func(msg *models.MessagePayload) bool {
+		if msg.Deleted {
+			return false
+		}
+		msg.Message = ""
+		msg.Deleted = true
+		msg.DeletedAt = &at
+		msg.DeletedBy = deletedBy
+		msg.Edits = nil
+		msg.Reactions = nil
+		return true
+	})
+}
+
+func (r *memoryMessageRepository) AddReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error) {
+	return r.updateReaction(messageID, func(msg *models.MessagePayload) bool {
+		reaction := msg.Reactions[emoji]
+		if msg.Deleted || containsUsername(reaction.Users, username) {
+			return false
+		}
+		if msg.Reactions == nil {
+			msg.Reactions = make(map[string]models.Reaction)
+		}
+		reaction.Users = append(reaction.Users, username)
+		reaction.Count++
+		msg.Reactions[emoji] = reaction
+		return true
+	})
+}
+
+func (r *memoryMessageRepository) RemoveReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error) {
+	return r.updateReaction(messageID, func(msg *models.MessagePayload) bool {
+		reaction := msg.Reactions[emoji]
+		if !containsUsername(reaction.Users, username) {
+			return false
+		}
+		users := make([]string, 0, len(reaction.Users)-1)
+		for _, user := range reaction.Users {
+			if user != username {
+				users = append(users, user)
+			}
+		}
+		reaction.Users = users
+		reaction.Count--
+		if reaction.Count <= 0 {
+			delete(msg.Reactions, emoji)
+		} else {
+			msg.Reactions[emoji] = reaction
+		}
+		return true
+	})
+}
+
+func (r *memoryMessageRepository) UpdateMessageReceipt(ctx context.Context, messageID primitive.ObjectID, username string, status string, at time.Time) (bool, error) {
+	_, err := r.update(messageID, func(msg *models.MessagePayload) bool {
+		for i := range msg.Receipts {
+			receipt := &msg.Receipts[i]
+			if receipt.Username != username {
+				continue
+			}
+			if status == models.ReceiptRead && receipt.ReadAt == nil {
+				receipt.ReadAt = &at
+				return true
+			}
+			if status == models.ReceiptDelivered && receipt.DeliveredAt == nil {
+				receipt.DeliveredAt = &at
+				return true
+			}
+			return false
+		}
+
+		receipt := models.MessageReceipt{Username: username, DeliveredAt: &at}
+		if status == models.ReceiptRead {
+			receipt.ReadAt = &at
+		}
+		msg.Receipts = append(msg.Receipts, receipt)
+		return true
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *memoryMessageRepository) UpsertReadMarker(ctx context.Context, marker models.ReadMarker) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := marker.Username + "\x00" + marker.Conversation
+	if existing, ok := r.readMarkers[key]; ok && !markerBefore(existing, marker) {
+		return false, nil
+	}
+	r.readMarkers[key] = marker
+	return true, nil
+}
+
+func (r *memoryMessageRepository) GetReadMarker(ctx context.Context, username string, conversation string) (models.ReadMarker, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if marker, ok := r.readMarkers[username+"\x00"+conversation]; ok {
+		return marker, nil
+	}
+	return models.ReadMarker{Username: username, Conversation: conversation}, nil
+}
+
+func (r *memoryMessageRepository) CountUnreadMessages(ctx context.Context, roomID uint, conversationID string, username string, after models.HistoryCursor) (int64, error) {
+	return int64(len(r.filter(func(msg models.MessagePayload) bool {
+		return inConversation(msg, roomID, conversationID) && msg.From != username && !msg.Deleted && compareCursor(msg, after) > 0
+	}))), nil
+}
+
+// filter returns copies of the messages matching match in no particular order.
+func (r *memoryMessageRepository) filter(match func(models.MessagePayload) bool) []models.MessagePayload {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var resp []models.MessagePayload
+	for _, msg := range r.messages {
+		if match(msg) {
+			resp = append(resp, cloneMessage(msg))
+		}
+	}
+	return resp
+}
+
+// findMessages pages through the messages matching match like the MongoDB
+// implementation: ordered by ascending date and ID, read backwards unless query.After
+// is set.
+func (r *memoryMessageRepository) findMessages(match func(models.MessagePayload) bool, query models.MessageHistoryQuery) []models.MessagePayload {
+	resp := r.filter(func(msg models.MessagePayload) bool {
+		return match(msg) &&
+			(query.Before.IsZero() || compareCursor(msg, query.Before) < 0) &&
+			(query.After.IsZero() || compareCursor(msg, query.After) > 0)
+	})
+	sortMessages(resp, false)
+
+	if int64(len(resp)) <= query.Limit {
+		return resp
+	}
+	if query.After.IsZero() {
+		return resp[int64(len(resp))-query.Limit:]
+	}
+	return resp[:query.Limit]
+}
+
+// update applies change to a copy of the message and stores it when change reports
+// that it applied. A message that does not exist or that change refused to modify is
+// reported as mongo.ErrNoDocuments, like a conditional update in MongoDB.
+func (r *memoryMessageRepository) update(messageID primitive.ObjectID, change func(*models.MessagePayload) bool) (models.MessagePayload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return models.MessagePayload{}, mongo.ErrNoDocuments
+	}
+	msg = cloneMessage(msg)
+	if !change(&msg) {
+		return models.MessagePayload{}, mongo.ErrNoDocuments
+	}
+	r.messages[messageID] = msg
+	return cloneMessage(msg), nil
+}
+
+// updateReaction applies a reaction change, returning the message unchanged when the
+// reaction is already in the requested state.
+func (r *memoryMessageRepository) updateReaction(messageID primitive.ObjectID, change func(*models.MessagePayload) bool) (models.MessagePayload, bool, error) {
+	resp, err := r.update(messageID, change)
+	if err == nil {
+		return resp, true, nil
+	}
+	resp, err = r.GetMessageByID(context.Background(), messageID)
+	return resp, false, err
+}
+
+// inConversation is the in-memory counterpart of conversationFilter.
+func inConversation(msg models.MessagePayload, roomID uint, conversationID string) bool {
+	switch {
+	case roomID != 0:
+		return msg.RoomID == roomID
+	case conversationID != "":
+		return msg.ConversationID == conversationID
+	default:
+		return msg.RoomID == 0 && msg.ConversationID == ""
+	}
+}
+
+// accessibleTo is the in-memory counterpart of accessibleBy.
+func accessibleTo(msg models.MessagePayload, username string, roomIDs []uint) bool {
+	switch {
+	case msg.RoomID != 0:
+		for _, roomID := range roomIDs {
+			if msg.RoomID == roomID {
+				return true
+			}
+		}
+		return false
+	case msg.ConversationID != "":
+		return msg.From == username || msg.To == username
+	default:
+		return true
+	}
+}
+
+// sortMessages orders messages by date and ID, newest first when descending is set.
+func sortMessages(messages []models.MessagePayload, descending bool) {
+	sort.Slice(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if descending {
+			a, b = b, a
+		}
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return a.ID.Hex() < b.ID.Hex()
+	})
+}
+
+// compareCursor orders msg against cursor like cursorBound: by date, then by ID unless
+// the cursor has none.
+func compareCursor(msg models.MessagePayload, cursor models.HistoryCursor) int {
+	switch {
+	case msg.Date.Before(cursor.Date):
+		return -1
+	case msg.Date.After(cursor.Date):
+		return 1
+	case cursor.ID.IsZero():
+		return 0
+	}
+	return strings.Compare(msg.ID.Hex(), cursor.ID.Hex())
+}
+
+// markerBefore reports whether the message of marker a is ordered before the one of b.
+func markerBefore(a models.ReadMarker, b models.ReadMarker) bool {
+	if !a.MessageDate.Equal(b.MessageDate) {
+		return a.MessageDate.Before(b.MessageDate)
+	}
+	return a.MessageID.Hex() < b.MessageID.Hex()
+}
+
+func containsUsername(usernames []string, username string) bool {
+	for _, user := range usernames {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneMessage copies the slices and maps of a message so that the copy can be
+// modified without touching the original.
+func cloneMessage(msg models.MessagePayload) models.MessagePayload {
+	msg.Receipts = append([]models.MessageReceipt(nil), msg.Receipts...)
+	msg.Edits = append([]models.MessageEdit(nil), msg.Edits...)
+	msg.ThreadParticipants = append([]string(nil), msg.ThreadParticipants...)
+	if msg.Reactions != nil {
+		reactions := make(map[string]models.Reaction, len(msg.Reactions))
+		for emoji, reaction := range msg.Reactions {
+			reaction.Users = append([]string(nil), reaction.Users...)
+			reactions[emoji] = reaction
+		}
+		msg.Reactions = reactions
+	}
+	return msg
+}
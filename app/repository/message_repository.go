@@ -2,34 +2,454 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kooroshh/fiber-boostrap/app/models"
-	"github.com/kooroshh/fiber-boostrap/pkg/database"
 	"go.elastic.co/apm"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func InsertNewMessage(ctx context.Context, data models.MessagePayload) error {
+type messageRepository struct {
+	messages    *mongo.Collection
+	readMarkers *mongo.Collection
+}
+
+// NewMessageRepository returns a MessageRepository storing messages in the messages
+// collection and read markers in the readMarkers collection. The indexes it relies
+// on are created by database.SetupMongoDB.
+func NewMessageRepository(messages *mongo.Collection, readMarkers *mongo.Collection) MessageRepository {
+	return &messageRepository{messages: messages, readMarkers: readMarkers}
+}
+
+// InsertNewMessage stores data under a new server-generated ID and returns the stored
+// message. When the sender already stored a message with the same client_msg_id the
+// earlier message is returned instead and duplicate is true.
+func (r *messageRepository) InsertNewMessage(ctx context.Context, data models.MessagePayload) (models.MessagePayload, bool, error) {
 	span, _ := apm.StartSpan(ctx, "InsertNewMessage", "repository")
 	defer span.End()
 
-	_, err := database.MongoDB.InsertOne(ctx, data)
-	return err
+	data.ID = primitive.NewObjectID()
+	_, err := r.messages.InsertOne(ctx, data)
+	if err == nil || data.ClientMsgID == "" || !mongo.IsDuplicateKeyError(err) {
+		return data, false, err
+	}
+
+	var existing models.MessagePayload
+	err = r.messages.FindOne(ctx, bson.D{
+		{Key: "from", Value: data.From},
+		{Key: "client_msg_id", Value: data.ClientMsgID},
+	}).Decode(&existing)
+	return existing, true, err
 }
 
-func GetAllMessage(ctx context.Context) ([]models.MessagePayload, error) {
+func (r *messageRepository) GetAllMessage(ctx context.Context, roomID uint, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
 	span, _ := apm.StartSpan(ctx, "GetAllMessage", "repository")
 	defer span.End()
 
+	return r.findMessages(ctx, append(conversationFilter(roomID, ""), notInThread), query)
+}
+
+func (r *messageRepository) GetDirectMessages(ctx context.Context, conversationID string, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "GetDirectMessages", "repository")
+	defer span.End()
+
+	return r.findMessages(ctx, append(conversationFilter(0, conversationID), notInThread), query)
+}
+
+func (r *messageRepository) GetThreadMessages(ctx context.Context, rootID primitive.ObjectID, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "GetThreadMessages", "repository")
+	defer span.End()
+
+	return r.findMessages(ctx, bson.D{{Key: "thread_root", Value: rootID}}, query)
+}
+
+// UpdateThreadRoot counts a new reply of username on the thread root and adds the
+// user to the thread participants. It returns the updated root.
+func (r *messageRepository) UpdateThreadRoot(ctx context.Context, rootID primitive.ObjectID, username string, at time.Time) (models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "UpdateThreadRoot", "repository")
+	defer span.End()
+
+	var resp models.MessagePayload
+	err := r.messages.FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: rootID}}, bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "reply_count", Value: 1}}},
+		{Key: "$max", Value: bson.D{{Key: "last_reply_at", Value: at}}},
+		{Key: "$addToSet", Value: bson.D{{Key: "thread_participants", Value: username}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&resp)
+	return resp, err
+}
+
+func (r *messageRepository) GetMessageByID(ctx context.Context, messageID primitive.ObjectID) (models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "GetMessageByID", "repository")
+	defer span.End()
+
+	var resp models.MessagePayload
+	err := r.messages.FindOne(ctx, bson.D{{Key: "_id", Value: messageID}}).Decode(&resp)
+	return resp, err
+}
+
+// UpdateMessageText replaces the text of a message that is not deleted and appends the
+// previous text and the editor to its edit history. It returns the updated message, or
+// mongo.ErrNoDocuments when the message does not exist, was deleted or was changed
+// concurrently since previous was read.
+func (r *messageRepository) UpdateMessageText(ctx context.Context, messageID primitive.ObjectID, previous string, message string, editedBy string, at time.Time) (models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "UpdateMessageText", "repository")
+	defer span.End()
+
+	var resp models.MessagePayload
+	err := r.messages.FindOneAndUpdate(ctx, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: "message", Value: previous},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "message", Value: message}, {Key: "edited_at", Value: at}}},
+		{Key: "$push", Value: bson.D{{Key: "edits", Value: models.MessageEdit{Message: previous, EditedBy: editedBy, EditedAt: at}}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&resp)
+	return resp, err
+}
+
+// SoftDeleteMessage turns a message into a tombstone: the text, edit history and
+// reactions are removed while the ID, sender and date stay so that replies and history keep their
+// place. It returns the tombstone, or mongo.ErrNoDocuments when the message does not
+// exist or was already deleted.
+func (r *messageRepository) SoftDeleteMessage(ctx context.Context, messageID primitive.ObjectID, deletedBy string, at time.Time) (models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "SoftDeleteMessage", "repository")
+	defer span.End()
+
+	var resp models.MessagePayload
+	err := r.messages.FindOneAndUpdate(ctx, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+	}, bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "message", Value: ""},
+			{Key: "deleted", Value: true},
+			{Key: "deleted_at", Value: at},
+			{Key: "deleted_by", Value: deletedBy},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "edits", Value: ""}, {Key: "reactions", Value: ""}}},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&resp)
+	return resp, err
+}
+
+// AddReaction records that username reacted to a message that is not deleted with the
+// emoji. It returns the message after the change and whether anything changed, which
+// is false when the user had already reacted with that emoji.
+func (r *messageRepository) AddReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error) {
+	span, _ := apm.StartSpan(ctx, "AddReaction", "repository")
+	defer span.End()
+
+	field := "reactions." + emoji
+	return r.updateReaction(ctx, messageID, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+		{Key: field + ".users", Value: bson.D{{Key: "$ne", Value: username}}},
+	}, bson.D{
+		{Key: "$addToSet", Value: bson.D{{Key: field + ".users", Value: username}}},
+		{Key: "$inc", Value: bson.D{{Key: field + ".count", Value: 1}}},
+	})
+}
+
+// RemoveReaction removes the reaction of username with the emoji from a message, and
+// the emoji itself once nobody reacts with it anymore. It returns the message after
+// the change and whether anything changed.
+func (r *messageRepository) RemoveReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error) {
+	span, _ := apm.StartSpan(ctx, "RemoveReaction", "repository")
+	defer span.End()
+
+	field := "reactions." + emoji
+	resp, changed, err := r.updateReaction(ctx, messageID, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: field + ".users", Value: username},
+	}, bson.D{
+		{Key: "$pull", Value: bson.D{{Key: field + ".users", Value: username}}},
+		{Key: "$inc", Value: bson.D{{Key: field + ".count", Value: -1}}},
+	})
+	if err != nil || !changed || resp.Reactions[emoji].Count > 0 {
+		return resp, changed, err
+	}
+
+	_, err = r.messages.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: field + ".count", Value: bson.D{{Key: "$lte", Value: 0}}},
+	}, bson.D{{Key: "$unset", Value: bson.D{{Key: field, Value: ""}}}})
+	delete(resp.Reactions, emoji)
+	return resp, true, err
+}
+
+// updateReaction applies a reaction update guarded by filter. When the filter does not
+// match, because the reaction is already in the requested state, the message is
+// returned unchanged.
+func (r *messageRepository) updateReaction(ctx context.Context, messageID primitive.ObjectID, filter bson.D, update bson.D) (models.MessagePayload, bool, error) {
+	var resp models.MessagePayload
+	err := r.messages.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&resp)
+	if err == nil {
+		return resp, true, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return resp, false, err
+	}
+
+	resp, err = r.GetMessageByID(ctx, messageID)
+	return resp, false, err
+}
+
+// UpdateMessageReceipt records that username got (models.ReceiptDelivered) or read
+// (models.ReceiptRead) the message at the given time. Reading implies delivery. It
+// reports whether the receipt changed, which is false when the state was already
+// recorded earlier.
+func (r *messageRepository) UpdateMessageReceipt(ctx context.Context, messageID primitive.ObjectID, username string, status string, at time.Time) (bool, error) {
+	span, _ := apm.StartSpan(ctx, "UpdateMessageReceipt", "repository")
+	defer span.End()
+
+	field := "delivered_at"
+	receipt := models.MessageReceipt{Username: username, DeliveredAt: &at}
+	if status == models.ReceiptRead {
+		field = "read_at"
+		receipt.ReadAt = &at
+	}
+
+	// First receipt of this recipient.
+	res, err := r.messages.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: "receipts.username", Value: bson.D{{Key: "$ne", Value: username}}},
+	}, bson.D{{Key: "$push", Value: bson.D{{Key: "receipts", Value: receipt}}}})
+	if err != nil {
+		return false, fmt.Errorf("failed to push receipt: %v", err)
+	}
+	if res.ModifiedCount > 0 {
+		return true, nil
+	}
+
+	// Later receipt of a recipient that already has one, e.g. read after delivered.
+	res, err = r.messages.UpdateOne(ctx, bson.D{
+		{Key: "_id", Value: messageID},
+		{Key: "receipts", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+			{Key: "username", Value: username},
+			{Key: field, Value: bson.D{{Key: "$exists", Value: false}}},
+		}}}},
+	}, bson.D{{Key: "$set", Value: bson.D{{Key: "receipts.$." + field, Value: at}}}})
+	if err != nil {
+		return false, fmt.Errorf("failed to set receipt: %v", err)
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// UpsertReadMarker moves the read marker of the user in the conversation forward to
+// the given message. A marker that already points at a newer message is kept, in which
+// case advanced is false.
+func (r *messageRepository) UpsertReadMarker(ctx context.Context, marker models.ReadMarker) (bool, error) {
+	span, _ := apm.StartSpan(ctx, "UpsertReadMarker", "repository")
+	defer span.End()
+
+	_, err := r.readMarkers.UpdateOne(ctx, bson.D{
+		{Key: "username", Value: marker.Username},
+		{Key: "conversation", Value: marker.Conversation},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "message_date", Value: bson.D{{Key: "$lt", Value: marker.MessageDate}}}},
+			bson.D{{Key: "message_date", Value: marker.MessageDate}, {Key: "message_id", Value: bson.D{{Key: "$lt", Value: marker.MessageID}}}},
+		}},
+	}, bson.D{{Key: "$set", Value: marker}}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetReadMarker returns the read marker of the user in the conversation, or a marker
+// with a zero MessageID when the user has not read anything there yet.
+func (r *messageRepository) GetReadMarker(ctx context.Context, username string, conversation string) (models.ReadMarker, error) {
+	span, _ := apm.StartSpan(ctx, "GetReadMarker", "repository")
+	defer span.End()
+
+	resp := models.ReadMarker{Username: username, Conversation: conversation}
+	err := r.readMarkers.FindOne(ctx, bson.D{
+		{Key: "username", Value: username},
+		{Key: "conversation", Value: conversation},
+	}).Decode(&resp)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return resp, nil
+	}
+	return resp, err
+}
+
+// CountUnreadMessages counts the messages of the conversation given by roomID or
+// conversationID (see GetAllMessage and GetDirectMessages) that are ordered after
+// after, are not deleted and were not sent by username.
+func (r *messageRepository) CountUnreadMessages(ctx context.Context, roomID uint, conversationID string, username string, after models.HistoryCursor) (int64, error) {
+	span, _ := apm.StartSpan(ctx, "CountUnreadMessages", "repository")
+	defer span.End()
+
+	filter := append(conversationFilter(roomID, conversationID),
+		bson.E{Key: "from", Value: bson.D{{Key: "$ne", Value: username}}},
+		bson.E{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+	)
+	filter = append(filter, cursorBound("$gt", after)...)
+	return r.messages.CountDocuments(ctx, filter)
+}
+
+// SearchMessages returns one page of the messages whose text matches query.Text and
+// that username can read: the global channel, the rooms in roomIDs and the direct
+// conversations username takes part in. Deleted messages are never returned.
+func (r *messageRepository) SearchMessages(ctx context.Context, query models.MessageSearchQuery, username string, roomIDs []uint) ([]models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "SearchMessages", "repository")
+	defer span.End()
+
 	var (
 		err  error
 		resp []models.MessagePayload
 	)
-	cursor, err := database.MongoDB.Find(ctx, bson.D{})
+
+	filter := bson.D{
+		{Key: "$text", Value: bson.D{{Key: "$search", Value: query.Text}}},
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+		accessibleBy(username, roomIDs),
+	}
+	if query.From != "" {
+		filter = append(filter, bson.E{Key: "from", Value: query.From})
+	}
+	if query.RoomID != 0 {
+		filter = append(filter, bson.E{Key: "room_id", Value: query.RoomID})
+	}
+
+	dateRange := bson.D{}
+	if !query.Since.IsZero() {
+		dateRange = append(dateRange, bson.E{Key: "$gte", Value: query.Since})
+	}
+	if !query.Until.IsZero() {
+		dateRange = append(dateRange, bson.E{Key: "$lte", Value: query.Until})
+	}
+	if len(dateRange) > 0 {
+		filter = append(filter, bson.E{Key: "date", Value: dateRange})
+	}
+
+	score := bson.D{{Key: "$meta", Value: "textScore"}}
+	sort := bson.D{{Key: "score", Value: score}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}}
+	if query.Sort == models.SearchSortDate {
+		sort = bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: -1}}
+	}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "score", Value: score}}).
+		SetSort(sort).
+		SetSkip(query.Offset).
+		SetLimit(query.Limit)
+
+	cursor, err := r.messages.Find(ctx, filter, opts)
 	if err != nil {
-		return resp, fmt.Errorf("failed to get all message: %v", err)
+		return resp, fmt.Errorf("failed to search messages: %v", err)
 	}
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &resp)
+	if err != nil {
+		return resp, fmt.Errorf("failed to decode messages: %v", err)
+	}
+	return resp, nil
+}
+
+// GetMessagesSince returns up to limit messages ordered after since that username can
+// read, ordered by ascending date and ID. Deleted messages are left out.
+func (r *messageRepository) GetMessagesSince(ctx context.Context, username string, roomIDs []uint, since models.HistoryCursor, limit int64) ([]models.MessagePayload, error) {
+	span, _ := apm.StartSpan(ctx, "GetMessagesSince", "repository")
+	defer span.End()
+
+	var (
+		err  error
+		resp []models.MessagePayload
+	)
+
+	filter := bson.D{
+		{Key: "deleted", Value: bson.D{{Key: "$ne", Value: true}}},
+		// Both the cursor bound and the access check are $or expressions.
+		{Key: "$and", Value: bson.A{cursorBound("$gt", since), bson.D{accessibleBy(username, roomIDs)}}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(limit)
+
+	cursor, err := r.messages.Find(ctx, filter, opts)
+	if err != nil {
+		return resp, fmt.Errorf("failed to find messages: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &resp)
+	if err != nil {
+		return resp, fmt.Errorf("failed to decode messages: %v", err)
+	}
+	return resp, nil
+}
+
+// accessibleBy selects the messages username can read: the global channel, the rooms
+// in roomIDs and the direct conversations username takes part in.
+func accessibleBy(username string, roomIDs []uint) bson.E {
+	accessible := bson.A{
+		conversationFilter(0, ""),
+		bson.D{
+			{Key: "conversation_id", Value: bson.D{{Key: "$exists", Value: true}}},
+			{Key: "$or", Value: bson.A{bson.D{{Key: "from", Value: username}}, bson.D{{Key: "to", Value: username}}}},
+		},
+	}
+	if len(roomIDs) > 0 {
+		accessible = append(accessible, bson.D{{Key: "room_id", Value: bson.D{{Key: "$in", Value: roomIDs}}}})
+	}
+	return bson.E{Key: "$or", Value: accessible}
+}
+
+// notInThread keeps thread replies out of the main history of a conversation, they
+// are read through GetThreadMessages instead.
+var notInThread = bson.E{Key: "thread_root", Value: bson.D{{Key: "$exists", Value: false}}}
+
+// conversationFilter selects the messages of a room when roomID is set, of a direct
+// conversation when conversationID is set, and of the global channel otherwise.
+func conversationFilter(roomID uint, conversationID string) bson.D {
+	switch {
+	case roomID != 0:
+		return bson.D{{Key: "room_id", Value: roomID}}
+	case conversationID != "":
+		return bson.D{{Key: "conversation_id", Value: conversationID}}
+	default:
+		return bson.D{
+			{Key: "room_id", Value: bson.D{{Key: "$exists", Value: false}}},
+			{Key: "conversation_id", Value: bson.D{{Key: "$exists", Value: false}}},
+		}
+	}
+}
+
+// findMessages returns one page of the messages matching filter, always ordered by
+// ascending date and ID regardless of the paging direction of query.
+func (r *messageRepository) findMessages(ctx context.Context, filter bson.D, query models.MessageHistoryQuery) ([]models.MessagePayload, error) {
+	var (
+		err  error
+		resp []models.MessagePayload
+	)
+
+	bounds := bson.A{}
+	if !query.Before.IsZero() {
+		bounds = append(bounds, cursorBound("$lt", query.Before))
+	}
+	if !query.After.IsZero() {
+		bounds = append(bounds, cursorBound("$gt", query.After))
+	}
+	if len(bounds) > 0 {
+		filter = append(filter, bson.E{Key: "$and", Value: bounds})
+	}
+
+	forward := !query.After.IsZero()
+	sortOrder := -1
+	if forward {
+		sortOrder = 1
+	}
+	sort := bson.D{{Key: "date", Value: sortOrder}, {Key: "_id", Value: sortOrder}}
+	opts := options.Find().SetSort(sort).SetLimit(query.Limit)
+
+	cursor, err := r.messages.Find(ctx, filter, opts)
+	if err != nil {
+		return resp, fmt.Errorf("failed to find messages: %v", err)
+	}
+	defer cursor.Close(ctx)
 
 	for cursor.Next(ctx) {
 		payload := models.MessagePayload{}
@@ -38,5 +458,27 @@ func GetAllMessage(ctx context.Context) ([]models.MessagePayload, error) {
 		}
 		resp = append(resp, payload)
 	}
+	if err = cursor.Err(); err != nil {
+		return resp, fmt.Errorf("failed to iterate messages: %v", err)
+	}
+
+	if !forward {
+		for i, j := 0, len(resp)-1; i < j; i, j = i+1, j-1 {
+			resp[i], resp[j] = resp[j], resp[i]
+		}
+	}
 	return resp, nil
 }
+
+// cursorBound matches the messages ordered before ($lt) or after ($gt) cursor by date
+// and ID.
+func cursorBound(op string, cursor models.HistoryCursor) bson.D {
+	byDate := bson.D{{Key: "date", Value: bson.D{{Key: op, Value: cursor.Date}}}}
+	if cursor.ID.IsZero() {
+		return byDate
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		byDate,
+		bson.D{{Key: "date", Value: cursor.Date}, {Key: "_id", Value: bson.D{{Key: op, Value: cursor.ID}}}},
+	}}}
+}
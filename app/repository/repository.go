@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+// UserRepository stores user accounts. Lookups of a missing user fail with
+// gorm.ErrRecordNotFound.
+type UserRepository interface {
+	InsertNewUser(ctx context.Context, user *models.User) error
+	GetUserByUsername(ctx context.Context, username string) (models.User, error)
+	GetUsersByUsernames(ctx context.Context, usernames []string) ([]models.User, error)
+	UpdateUserLastSeen(ctx context.Context, userID uint, lastSeenAt time.Time) error
+}
+
+// SessionRepository stores the sessions created on login and the refresh tokens they
+// retired. Tokens are looked up by their hash, see models.HashToken. Lookups of a
+// missing session or token fail with gorm.ErrRecordNotFound.
+type SessionRepository interface {
+	InsertNewUserSession(ctx context.Context, session *models.UserSession) error
+	GetUserSessionByToken(ctx context.Context, token string) (models.UserSession, error)
+	GetUserSessionByRefreshToken(ctx context.Context, refreshToken string) (models.UserSession, error)
+	// GetUserSessionsByUserID returns the sessions of a user whose refresh token has
+	// not expired, most recently used first.
+	GetUserSessionsByUserID(ctx context.Context, userID uint) ([]models.UserSession, error)
+	UpdateUserSessionLastUsed(ctx context.Context, sessionID uint, at time.Time) error
+	DeleteUserSessionByToken(ctx context.Context, token string) error
+	// DeleteUserSessionByID fails with gorm.ErrRecordNotFound when the user has no
+	// session with that ID.
+	DeleteUserSessionByID(ctx context.Context, userID uint, sessionID uint) error
+	// RotateUserSessionToken stores the tokens of session and retires the refresh
+	// token it replaces. It fails with gorm.ErrRecordNotFound when the session no
+	// longer holds retired.RefreshTokenHash, i.e. it was rotated or revoked concurrently.
+	RotateUserSessionToken(ctx context.Context, session models.UserSession, retired models.RetiredRefreshToken) error
+	GetRetiredRefreshToken(ctx context.Context, refreshToken string) (models.RetiredRefreshToken, error)
+	// DeleteUserSessionsByUserID and DeleteUserSessionsByFamily return the IDs of the
+	// deleted sessions.
+	DeleteUserSessionsByUserID(ctx context.Context, userID uint) ([]uint, error)
+	DeleteUserSessionsByFamily(ctx context.Context, familyID string) ([]uint, error)
+}
+
+// LoginBlockFunc returns how long logins are blocked after the given number of failed
+// attempts, and whether the block is an account lockout.
+type LoginBlockFunc func(failures int) (time.Duration, bool)
+
+// LoginThrottleRepository stores the failed login counters.
+type LoginThrottleRepository interface {
+	// ReserveLoginAttempt counts a login attempt for key at now before its credentials
+	// are checked, as if it failed, and blocks logins for key as block returns for the
+	// new count. It returns the counter and whether the attempt was counted; while
+	// logins for key are blocked nothing is counted. Checking and counting are atomic,
+	// so that concurrent attempts cannot all pass before any of them is counted.
+	// Failures more than window before now are forgotten.
+	ReserveLoginAttempt(ctx context.Context, key string, now time.Time, window time.Duration, block LoginBlockFunc) (models.LoginThrottle, bool, error)
+	// ReleaseLoginAttempt takes back an attempt counted for key that did not fail. The
+	// block is recomputed for the failures left, starting at the last attempt.
+	ReleaseLoginAttempt(ctx context.Context, key string, block LoginBlockFunc) error
+	DeleteLoginThrottle(ctx context.Context, key string) error
+	// DeleteForgottenLoginThrottles deletes up to limit counters whose last failure is
+	// before the given time and that no longer block logins at now. It returns how many
+	// it deleted.
+	DeleteForgottenLoginThrottles(ctx context.Context, before time.Time, now time.Time, limit int) (int64, error)
+}
+
+// SecurityEventRepository stores the security events of the accounts.
+type SecurityEventRepository interface {
+	InsertSecurityEvent(ctx context.Context, event *models.SecurityEvent) error
+}
+
+// RoomRepository stores rooms and their members. Lookups of a missing room fail with
+// gorm.ErrRecordNotFound.
+type RoomRepository interface {
+	InsertNewRoom(ctx context.Context, room *models.Room) error
+	GetRoomByID(ctx context.Context, roomID uint) (models.Room, error)
+	GetRoomsVisibleToUser(ctx context.Context, userID uint) ([]models.Room, error)
+	InsertRoomMember(ctx context.Context, member *models.RoomMember) error
+	DeleteRoomMember(ctx context.Context, roomID uint, userID uint) error
+	IsRoomMember(ctx context.Context, roomID uint, userID uint) (bool, error)
+	GetRoomMemberUsernames(ctx context.Context, roomID uint) ([]string, error)
+	GetRoomIDsOfMember(ctx context.Context, userID uint) ([]uint, error)
+}
+
+// MessageRepository stores messages together with their receipts, reactions and
+// threads, and the read markers of the users. Lookups and conditional updates of a
+// missing message fail with mongo.ErrNoDocuments.
+type MessageRepository interface {
+	InsertNewMessage(ctx context.Context, data models.MessagePayload) (models.MessagePayload, bool, error)
+	GetAllMessage(ctx context.Context, roomID uint, query models.MessageHistoryQuery) ([]models.MessagePayload, error)
+	GetDirectMessages(ctx context.Context, conversationID string, query models.MessageHistoryQuery) ([]models.MessagePayload, error)
+	GetThreadMessages(ctx context.Context, rootID primitive.ObjectID, query models.MessageHistoryQuery) ([]models.MessagePayload, error)
+	GetMessagesSince(ctx context.Context, username string, roomIDs []uint, since models.HistoryCursor, limit int64) ([]models.MessagePayload, error)
+	SearchMessages(ctx context.Context, query models.MessageSearchQuery, username string, roomIDs []uint) ([]models.MessagePayload, error)
+	GetMessageByID(ctx context.Context, messageID primitive.ObjectID) (models.MessagePayload, error)
+	UpdateThreadRoot(ctx context.Context, rootID primitive.ObjectID, username string, at time.Time) (models.MessagePayload, error)
+	UpdateMessageText(ctx context.Context, messageID primitive.ObjectID, previous string, message string, editedBy string, at time.Time) (models.MessagePayload, error)
+	SoftDeleteMessage(ctx context.Context, messageID primitive.ObjectID, deletedBy string, at time.Time) (models.MessagePayload, error)
+	AddReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error)
+	RemoveReaction(ctx context.Context, messageID primitive.ObjectID, emoji string, username string) (models.MessagePayload, bool, error)
+	UpdateMessageReceipt(ctx context.Context, messageID primitive.ObjectID, username string, status string, at time.Time) (bool, error)
+	UpsertReadMarker(ctx context.Context, marker models.ReadMarker) (bool, error)
+	GetReadMarker(ctx context.Context, username string, conversation string) (models.ReadMarker, error)
+	CountUnreadMessages(ctx context.Context, roomID uint, conversationID string, username string, after models.HistoryCursor) (int64, error)
+}
+
+// Repositories bundles the repositories the controllers, middleware and WebSocket hub
+// depend on.
+type Repositories struct {
+	Users          UserRepository
+	Sessions       SessionRepository
+	SecurityEvents SecurityEventRepository
+	LoginThrottles LoginThrottleRepository
+	Rooms          RoomRepository
+	Messages       MessageRepository
+}
+
+// NewDatabaseRepositories returns repositories backed by the SQL database db and the
+// MongoDB collections holding the messages and the read markers.
+func NewDatabaseRepositories(db *gorm.DB, messages *mongo.Collection, readMarkers *mongo.Collection) Repositories {
+	return Repositories{
+		Users:          NewUserRepository(db),
+		Sessions:       NewSessionRepository(db),
+		SecurityEvents: NewSecurityEventRepository(db),
+		LoginThrottles: NewLoginThrottleRepository(db),
+		Rooms:          NewRoomRepository(db),
+		Messages:       NewMessageRepository(messages, readMarkers),
+	}
+}
@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type roomRepository struct {
+	db *gorm.DB
+}
+
+// NewRoomRepository returns a RoomRepository storing rooms and their members in db.
+func NewRoomRepository(db *gorm.DB) RoomRepository {
+	return &roomRepository{db: db}
+}
+
+func (r *roomRepository) InsertNewRoom(ctx context.Context, room *models.Room) error {
+	span, _ := apm.StartSpan(ctx, "InsertNewRoom", "repository")
+	defer span.End()
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.RoomMember{RoomID: room.ID, UserID: room.OwnerID}).Error
+	})
+}
+
+func (r *roomRepository) GetRoomByID(ctx context.Context, roomID uint) (models.Room, error) {
+	span, _ := apm.StartSpan(ctx, "GetRoomByID", "repository")
+	defer span.End()
+
+	var (
+		resp models.Room
+		err  error
+	)
+	err = r.db.Where("id = ?", roomID).First(&resp).Error
+	return resp, err
+}
+
+func (r *roomRepository) GetRoomsVisibleToUser(ctx context.Context, userID uint) ([]models.Room, error) {
+	span, _ := apm.StartSpan(ctx, "GetRoomsVisibleToUser", "repository")
+	defer span.End()
+
+	var (
+		resp []models.Room
+		err  error
+	)
+	err = r.db.
+		Where("is_private = ? OR id IN (?)", false, r.db.Model(&models.RoomMember{}).Select("room_id").Where("user_id = ?", userID)).
+		Order("id").
+		Find(&resp).Error
+	return resp, err
+}
+
+func (r *roomRepository) InsertRoomMember(ctx context.Context, member *models.RoomMember) error {
+	span, _ := apm.StartSpan(ctx, "InsertRoomMember", "repository")
+	defer span.End()
+
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(member).Error
+}
+
+func (r *roomRepository) DeleteRoomMember(ctx context.Context, roomID uint, userID uint) error {
+	span, _ := apm.StartSpan(ctx, "DeleteRoomMember", "repository")
+	defer span.End()
+
+	return r.db.Exec("DELETE FROM room_members WHERE room_id = ? AND user_id = ?", roomID, userID).Error
+}
+
+func (r *roomRepository) IsRoomMember(ctx context.Context, roomID uint, userID uint) (bool, error) {
+	span, _ := apm.StartSpan(ctx, "IsRoomMember", "repository")
+	defer span.End()
+
+	var count int64
+	err := r.db.Model(&models.RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+func (r *roomRepository) GetRoomMemberUsernames(ctx context.Context, roomID uint) ([]string, error) {
+	span, _ := apm.StartSpan(ctx, "GetRoomMemberUsernames", "repository")
+	defer span.End()
+
+	var (
+		resp []string
+		err  error
+	)
+	err = r.db.Model(&models.User{}).
+		Joins("JOIN room_members ON room_members.user_id = users.id").
+		Where("room_members.room_id = ?", roomID).
+		Pluck("users.username", &resp).Error
+	return resp, err
+}
+
+func (r *roomRepository) GetRoomIDsOfMember(ctx context.Context, userID uint) ([]uint, error) {
+	span, _ := apm.StartSpan(ctx, "GetRoomIDsOfMember", "repository")
+	defer span.End()
+
+	var (
+		resp []uint
+		err  error
+	)
+	err = r.db.Model(&models.RoomMember{}).Where("user_id = ?", userID).Pluck("room_id", &resp).Error
+	return resp, err
+}
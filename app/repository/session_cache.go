@@ -0,0 +1,240 @@
+package repository
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+)
+
+// SessionCache caches valid sessions by their access token. Cached sessions never hold
+// the hash of their refresh token.
+type SessionCache interface {
+	Get(ctx context.Context, token string) (models.UserSession, bool)
+	// Set caches session, which was loaded at loadedAt, unless the session has been
+	// invalidated since. A lookup racing with a revocation thus cannot cache the
+	// revoked session again.
+	Set(ctx context.Context, session models.UserSession, loadedAt time.Time)
+	// Touch moves the last used time of the cached entries of a session forward to at
+	// in place, since only the time changed.
+	Touch(ctx context.Context, sessionID uint, at time.Time)
+	// Invalidate drops every cached entry of the given sessions.
+	Invalidate(ctx context.Context, sessionIDs ...uint)
+	Close() error
+}
+
+type cachedSessionRepository struct {
+	SessionRepository
+	cache SessionCache
+}
+
+// NewCachedSessionRepository returns a SessionRepository that looks sessions up by token
+// in cache before asking sessions, and invalidates the cached entries of the sessions it
+// updates or deletes. Recording that a session was used updates its entries instead.
+func NewCachedSessionRepository(sessions SessionRepository, cache SessionCache) SessionRepository {
+	return &cachedSessionRepository{SessionRepository: sessions, cache: cache}
+}
+
+func (r *cachedSessionRepository) GetUserSessionByToken(ctx context.Context, token string) (models.UserSession, error) {
+	span, spanCtx := apm.StartSpan(ctx, "GetUserSessionByToken", "cache")
+	defer span.End()
+
+	if session, ok := r.cache.Get(spanCtx, token); ok {
+		return session, nil
+	}
+	loadedAt := time.Now()
+	session, err := r.SessionRepository.GetUserSessionByToken(spanCtx, token)
+	if err != nil {
+		return session, err
+	}
+	r.cache.Set(spanCtx, session, loadedAt)
+	return session, nil
+}
+
+func (r *cachedSessionRepository) UpdateUserSessionLastUsed(ctx context.Context, sessionID uint, at time.Time) error {
+	err := r.SessionRepository.UpdateUserSessionLastUsed(ctx, sessionID, at)
+	if err == nil {
+		r.cache.Touch(ctx, sessionID, at)
+	}
+	return err
+}
+
+func (r *cachedSessionRepository) RotateUserSessionToken(ctx context.Context, session models.UserSession, retired models.RetiredRefreshToken) error {
+	err := r.SessionRepository.RotateUserSessionToken(ctx, session, retired)
+	r.cache.Invalidate(ctx, session.ID)
+	return err
+}
+
+func (r *cachedSessionRepository) DeleteUserSessionByToken(ctx context.Context, token string) error {
+	session, err := r.GetUserSessionByToken(ctx, token)
+	if err != nil {
+		return r.SessionRepository.DeleteUserSessionByToken(ctx, token)
+	}
+	err = r.SessionRepository.DeleteUserSessionByToken(ctx, token)
+	r.cache.Invalidate(ctx, session.ID)
+	return err
+}
+
+func (r *cachedSessionRepository) DeleteUserSessionByID(ctx context.Context, userID uint, sessionID uint) error {
+	err := r.SessionRepository.DeleteUserSessionByID(ctx, userID, sessionID)
+	if err == nil {
+		r.cache.Invalidate(ctx, sessionID)
+	}
+	return err
+}
+
+func (r *cachedSessionRepository) DeleteUserSessionsByUserID(ctx context.Context, userID uint) ([]uint, error) {
+	ids, err := r.SessionRepository.DeleteUserSessionsByUserID(ctx, userID)
+	r.cache.Invalidate(ctx, ids...)
+	return ids, err
+}
+
+func (r *cachedSessionRepository) DeleteUserSessionsByFamily(ctx context.Context, familyID string) ([]uint, error) {
+	ids, err := r.SessionRepository.DeleteUserSessionsByFamily(ctx, familyID)
+	r.cache.Invalidate(ctx, ids...)
+	return ids, err
+}
+
+// cacheTTL returns how long session may stay cached: ttl, but not past the expiry of
+// its access token.
+func cacheTTL(session models.UserSession, ttl time.Duration, now time.Time) time.Duration {
+	if left := session.TokenExpired.Sub(now); left < ttl {
+		return left
+	}
+	return ttl
+}
+
+// LRUSessionCache is an in-process SessionCache holding up to size sessions, each for
+// at most ttl. The least recently used entry is evicted when it is full.
+type LRUSessionCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	// keys indexes the entries by session, a rotated session may have entries for
+	// several tokens.
+	keys map[uint]map[string]bool
+	// invalidated holds when each session was last invalidated.
+	invalidated map[uint]time.Time
+}
+
+type lruEntry struct {
+	key     string
+	session models.UserSession
+	expires time.Time
+}
+
+// NewLRUSessionCache creates an empty cache of size entries expiring after ttl.
+func NewLRUSessionCache(size int, ttl time.Duration) *LRUSessionCache {
+	return &LRUSessionCache{
+		size:        size,
+		ttl:         ttl,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+		keys:        make(map[uint]map[string]bool),
+		invalidated: make(map[uint]time.Time),
+	}
+}
+
+func (c *LRUSessionCache) Get(ctx context.Context, token string) (models.UserSession, bool) {
+	return c.get(models.HashToken(token), time.Now())
+}
+
+func (c *LRUSessionCache) get(key string, now time.Time) (models.UserSession, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return models.UserSession{}, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !now.Before(entry.expires) {
+		c.removeElement(elem)
+		return models.UserSession{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.session, true
+}
+
+func (c *LRUSessionCache) Set(ctx context.Context, session models.UserSession, loadedAt time.Time) {
+	now := time.Now()
+	ttl := cacheTTL(session, c.ttl, now)
+	if ttl <= 0 {
+		return
+	}
+	c.set(session.TokenHash, session, now.Add(ttl), loadedAt)
+}
+
+func (c *LRUSessionCache) set(key string, session models.UserSession, expires time.Time, loadedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if at, ok := c.invalidated[session.ID]; ok && !at.Before(loadedAt) {
+		return
+	}
+	session.RefreshTokenHash = ""
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, session: session, expires: expires})
+	if c.keys[session.ID] == nil {
+		c.keys[session.ID] = make(map[string]bool)
+	}
+	c.keys[session.ID][key] = true
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *LRUSessionCache) Touch(ctx context.Context, sessionID uint, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.keys[sessionID] {
+		entry := c.entries[key].Value.(*lruEntry)
+		if entry.session.LastUsedAt.Before(at) {
+			entry.session.LastUsedAt = at
+		}
+	}
+}
+
+func (c *LRUSessionCache) Invalidate(ctx context.Context, sessionIDs ...uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.invalidated) > c.size {
+		// Lookups do not take anywhere near ttl, older invalidations can be forgotten.
+		for id, at := range c.invalidated {
+			if now.Sub(at) > c.ttl {
+				delete(c.invalidated, id)
+			}
+		}
+	}
+	for _, id := range sessionIDs {
+		c.invalidated[id] = now
+		for key := range c.keys[id] {
+			c.removeElement(c.entries[key])
+		}
+	}
+}
+
+func (c *LRUSessionCache) Close() error {
+	return nil
+}
+
+// removeElement drops elem from the cache. The caller must hold c.mu.
+func (c *LRUSessionCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.entries, entry.key)
+	delete(c.keys[entry.session.ID], entry.key)
+	if len(c.keys[entry.session.ID]) == 0 {
+		delete(c.keys, entry.session.ID)
+	}
+}
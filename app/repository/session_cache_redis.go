@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisSessionCache is a two tier SessionCache: an in-process LRUSessionCache in front of
+// Redis, which the instances of the application share. Invalidations delete the Redis
+// entries and are published on a channel, so that every instance also drops the
+// sessions from its own LRU. Redis errors are logged and treated as cache misses.
+type RedisSessionCache struct {
+	local  *LRUSessionCache
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+	pubsub *redis.PubSub
+}
+
+// NewRedisSessionCache connects to the Redis server at url and creates a cache keeping
+// sessions for at most ttl, up to size of them in process. Keys and the invalidation
+// channel start with prefix. It fails when the server cannot be reached.
+func NewRedisSessionCache(url string, prefix string, size int, ttl time.Duration) (*RedisSessionCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+
+	c := &RedisSessionCache{local: NewLRUSessionCache(size, ttl), client: client, prefix: prefix, ttl: ttl}
+	c.pubsub = client.Subscribe(context.Background(), c.channel())
+	if _, err = c.pubsub.Receive(context.Background()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %v", c.channel(), err)
+	}
+	go c.listen()
+	return c, nil
+}
+
+func (c *RedisSessionCache) channel() string {
+	return c.prefix + ":invalidate"
+}
+
+func (c *RedisSessionCache) redisTokenKey(key string) string {
+	return c.prefix + ":token:" + key
+}
+
+func (c *RedisSessionCache) sessionKey(sessionID uint) string {
+	return c.prefix + ":id:" + strconv.FormatUint(uint64(sessionID), 10)
+}
+
+func (c *RedisSessionCache) invalidatedKey(sessionID uint) string {
+	return c.prefix + ":invalidated:" + strconv.FormatUint(uint64(sessionID), 10)
+}
+
+// redisSession is the encoding of a cached session in Redis. The JSON encoding of
+// models.UserSession leaves out the expiry times and is meant for clients.
+type redisSession struct {
+	ID           uint      `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	UserID       uint      `json:"user_id"`
+	FamilyID     string    `json:"family_id"`
+	TokenHash    string    `json:"token_hash"`
+	TokenExpired time.Time `json:"token_expired"`
+	UserAgent    string    `json:"user_agent"`
+	IP           string    `json:"ip"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+func newRedisSession(session models.UserSession) redisSession {
+	return redisSession{
+		ID:           session.ID,
+		CreatedAt:    session.CreatedAt,
+		UserID:       session.UserID,
+		FamilyID:     session.FamilyID,
+		TokenHash:    session.TokenHash,
+		TokenExpired: session.TokenExpired,
+		UserAgent:    session.UserAgent,
+		IP:           session.IP,
+		LastUsedAt:   session.LastUsedAt,
+	}
+}
+
+func (s redisSession) session() models.UserSession {
+	return models.UserSession{
+		ID:           s.ID,
+		CreatedAt:    s.CreatedAt,
+		UserID:       s.UserID,
+		FamilyID:     s.FamilyID,
+		TokenHash:    s.TokenHash,
+		TokenExpired: s.TokenExpired,
+		UserAgent:    s.UserAgent,
+		IP:           s.IP,
+		LastUsedAt:   s.LastUsedAt,
+	}
+}
+
+// listen drops the sessions invalidated by any instance from the local cache.
+func (c *RedisSessionCache) listen() {
+	for msg := range c.pubsub.Channel() {
+		var ids []uint
+		if err := json.Unmarshal([]byte(msg.Payload), &ids); err != nil {
+			log.Println("failed to decode session invalidation: ", err)
+			continue
+		}
+		c.local.Invalidate(context.Background(), ids...)
+	}
+}
+
+func (c *RedisSessionCache) Get(ctx context.Context, token string) (models.UserSession, bool) {
+	key := models.HashToken(token)
+	now := time.Now()
+	if session, ok := c.local.get(key, now); ok {
+		return session, true
+	}
+
+	data, err := c.client.Get(ctx, c.redisTokenKey(key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Println("failed to get session from redis: ", err)
+		}
+		return models.UserSession{}, false
+	}
+	var cached redisSession
+	if err = json.Unmarshal(data, &cached); err != nil {
+		log.Println("failed to decode cached session: ", err)
+		return models.UserSession{}, false
+	}
+	session := cached.session()
+	c.local.set(key, session, now.Add(cacheTTL(session, c.ttl, now)), now)
+	return session, true
+}
+
+func (c *RedisSessionCache) Set(ctx context.Context, session models.UserSession, loadedAt time.Time) {
+	key := session.TokenHash
+	now := time.Now()
+	ttl := cacheTTL(session, c.ttl, now)
+	if ttl <= 0 {
+		return
+	}
+	c.local.set(key, session, now.Add(ttl), loadedAt)
+
+	// Another instance may have invalidated the session while it was loaded.
+	invalidatedAt, err := c.client.Get(ctx, c.invalidatedKey(session.ID)).Int64()
+	if err == nil && invalidatedAt >= loadedAt.UnixNano() {
+		return
+	}
+	if err != nil && err != redis.Nil {
+		log.Println("failed to check session invalidation: ", err)
+		return
+	}
+
+	data, err := json.Marshal(newRedisSession(session))
+	if err != nil {
+		log.Println("failed to encode session: ", err)
+		return
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, c.redisTokenKey(key), data, ttl)
+		pipe.SAdd(ctx, c.sessionKey(session.ID), key)
+		pipe.Expire(ctx, c.sessionKey(session.ID), c.ttl)
+		return nil
+	})
+	if err != nil {
+		log.Println("failed to cache session in redis: ", err)
+	}
+}
+
+// Touch updates the Redis entries of the session without extending their expiry. An
+// entry invalidated meanwhile is not written back. The other instances keep their
+// local entries and store the time again once they find it stale.
+func (c *RedisSessionCache) Touch(ctx context.Context, sessionID uint, at time.Time) {
+	c.local.Touch(ctx, sessionID, at)
+
+	keys, err := c.client.SMembers(ctx, c.sessionKey(sessionID)).Result()
+	if err != nil {
+		log.Println("failed to get cached tokens of session: ", err)
+		return
+	}
+	for _, key := range keys {
+		data, err := c.client.Get(ctx, c.redisTokenKey(key)).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Println("failed to get session from redis: ", err)
+			continue
+		}
+		var cached redisSession
+		if err = json.Unmarshal(data, &cached); err != nil {
+			log.Println("failed to decode cached session: ", err)
+			continue
+		}
+		if !cached.LastUsedAt.Before(at) {
+			continue
+		}
+		cached.LastUsedAt = at
+		if data, err = json.Marshal(cached); err != nil {
+			log.Println("failed to encode session: ", err)
+			continue
+		}
+		err = c.client.SetArgs(ctx, c.redisTokenKey(key), data, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+		if err != nil && err != redis.Nil {
+			log.Println("failed to touch session in redis: ", err)
+		}
+	}
+}
+
+func (c *RedisSessionCache) Invalidate(ctx context.Context, sessionIDs ...uint) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	c.local.Invalidate(ctx, sessionIDs...)
+
+	now := time.Now().UnixNano()
+	for _, id := range sessionIDs {
+		if err := c.client.Set(ctx, c.invalidatedKey(id), now, c.ttl).Err(); err != nil {
+			log.Println("failed to mark session as invalidated: ", err)
+		}
+		keys, err := c.client.SMembers(ctx, c.sessionKey(id)).Result()
+		if err != nil {
+			log.Println("failed to get cached tokens of session: ", err)
+			continue
+		}
+		del := []string{c.sessionKey(id)}
+		for _, key := range keys {
+			del = append(del, c.redisTokenKey(key))
+		}
+		if err = c.client.Del(ctx, del...).Err(); err != nil {
+			log.Println("failed to invalidate session in redis: ", err)
+		}
+	}
+
+	payload, err := json.Marshal(sessionIDs)
+	if err != nil {
+		log.Println("failed to encode session invalidation: ", err)
+		return
+	}
+	if err = c.client.Publish(ctx, c.channel(), payload).Err(); err != nil {
+		log.Println("failed to publish session invalidation: ", err)
+	}
+}
+
+func (c *RedisSessionCache) Close() error {
+	if err := c.pubsub.Close(); err != nil {
+		log.Println("failed to close redis subscription: ", err)
+	}
+	return c.client.Close()
+}
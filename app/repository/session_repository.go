@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+	"gorm.io/gorm"
+)
+
+type sessionRepository struct {
+	db *gorm.DB
+}
+
+// NewSessionRepository returns a SessionRepository storing user sessions in db.
+func NewSessionRepository(db *gorm.DB) SessionRepository {
+	return &sessionRepository{db: db}
+}
+
+func (r *sessionRepository) InsertNewUserSession(ctx context.Context, session *models.UserSession) error {
+	span, _ := apm.StartSpan(ctx, "InsertNewUserSession", "repository")
+	defer span.End()
+
+	return r.db.Create(session).Error
+}
+
+func (r *sessionRepository) GetUserSessionByToken(ctx context.Context, token string) (models.UserSession, error) {
+	span, _ := apm.StartSpan(ctx, "GetUserSessionByToken", "repository")
+	defer span.End()
+
+	var (
+		resp models.UserSession
+		err  error
+	)
+	err = r.db.Where("token_hash = ?", models.HashToken(token)).Last(&resp).Error
+	return resp, err
+}
+
+func (r *sessionRepository) DeleteUserSessionByToken(ctx context.Context, token string) error {
+	span, _ := apm.StartSpan(ctx, "DeleteUserSessionByToken", "repository")
+	defer span.End()
+
+	return r.db.Exec("DELETE FROM user_sessions WHERE token_hash = ?", models.HashToken(token)).Error
+}
+
+func (r *sessionRepository) GetUserSessionByRefreshToken(ctx context.Context, refreshToken string) (models.UserSession, error) {
+	span, _ := apm.StartSpan(ctx, "GetUserSessionByRefreshToken", "repository")
+	defer span.End()
+
+	var (
+		resp models.UserSession
+		err  error
+	)
+	err = r.db.Where("refresh_token_hash = ?", models.HashToken(refreshToken)).Last(&resp).Error
+	return resp, err
+}
+
+func (r *sessionRepository) RotateUserSessionToken(ctx context.Context, session models.UserSession, retired models.RetiredRefreshToken) error {
+	span, _ := apm.StartSpan(ctx, "RotateUserSessionToken", "repository")
+	defer span.End()
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.UserSession{}).
+			Where("id = ? AND refresh_token_hash = ?", session.ID, retired.RefreshTokenHash).
+			Updates(map[string]interface{}{
+				"family_id":             session.FamilyID,
+				"token_hash":            session.TokenHash,
+				"token_expired":         session.TokenExpired,
+				"refresh_token_hash":    session.RefreshTokenHash,
+				"refresh_token_expired": session.RefreshTokenExpired,
+				"last_used_at":          session.LastUsedAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// Expired tokens are rejected before reuse is checked, no need to keep them.
+		err := tx.Where("expires_at < ?", time.Now()).Delete(&models.RetiredRefreshToken{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&retired).Error
+	})
+}
+
+func (r *sessionRepository) GetRetiredRefreshToken(ctx context.Context, refreshToken string) (models.RetiredRefreshToken, error) {
+	span, _ := apm.StartSpan(ctx, "GetRetiredRefreshToken", "repository")
+	defer span.End()
+
+	var (
+		resp models.RetiredRefreshToken
+		err  error
+	)
+	err = r.db.Where("refresh_token_hash = ?", models.HashToken(refreshToken)).Last(&resp).Error
+	return resp, err
+}
+
+func (r *sessionRepository) GetUserSessionsByUserID(ctx context.Context, userID uint) ([]models.UserSession, error) {
+	span, _ := apm.StartSpan(ctx, "GetUserSessionsByUserID", "repository")
+	defer span.End()
+
+	var (
+		resp []models.UserSession
+		err  error
+	)
+	err = r.db.Where("user_id = ? AND refresh_token_expired > ?", userID, time.Now()).
+		Order("last_used_at DESC, id DESC").
+		Find(&resp).Error
+	return resp, err
+}
+
+func (r *sessionRepository) UpdateUserSessionLastUsed(ctx context.Context, sessionID uint, at time.Time) error {
+	span, _ := apm.StartSpan(ctx, "UpdateUserSessionLastUsed", "repository")
+	defer span.End()
+
+	return r.db.Exec("UPDATE user_sessions SET last_used_at = ? WHERE id = ?", at, sessionID).Error
+}
+
+func (r *sessionRepository) DeleteUserSessionByID(ctx context.Context, userID uint, sessionID uint) error {
+	span, _ := apm.StartSpan(ctx, "DeleteUserSessionByID", "repository")
+	defer span.End()
+
+	result := r.db.Exec("DELETE FROM user_sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *sessionRepository) DeleteUserSessionsByUserID(ctx context.Context, userID uint) ([]uint, error) {
+	span, _ := apm.StartSpan(ctx, "DeleteUserSessionsByUserID", "repository")
+	defer span.End()
+
+	return r.deleteSessionsWhere("user_id = ?", userID)
+}
+
+func (r *sessionRepository) DeleteUserSessionsByFamily(ctx context.Context, familyID string) ([]uint, error) {
+	span, _ := apm.StartSpan(ctx, "DeleteUserSessionsByFamily", "repository")
+	defer span.End()
+
+	return r.deleteSessionsWhere("family_id = ?", familyID)
+}
+
+// deleteSessionsWhere deletes the sessions matching the condition and returns their IDs.
+func (r *sessionRepository) deleteSessionsWhere(query string, args ...interface{}) ([]uint, error) {
+	var ids []uint
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.UserSession{}).Where(query, args...).Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.UserSession{}).Error
+	})
+	return ids, err
+}
+
+type securityEventRepository struct {
+	db *gorm.DB
+}
+
+// NewSecurityEventRepository returns a SecurityEventRepository storing security events
+// in db.
+func NewSecurityEventRepository(db *gorm.DB) SecurityEventRepository {
+	return &securityEventRepository{db: db}
+}
+
+func (r *securityEventRepository) InsertSecurityEvent(ctx context.Context, event *models.SecurityEvent) error {
+	span, _ := apm.StartSpan(ctx, "InsertSecurityEvent", "repository")
+	defer span.End()
+
+	return r.db.Create(event).Error
+}
@@ -5,58 +5,53 @@ import (
 	"time"
 
 	"github.com/kooroshh/fiber-boostrap/app/models"
-	"github.com/kooroshh/fiber-boostrap/pkg/database"
 	"go.elastic.co/apm"
+	"gorm.io/gorm"
 )
 
-func InsertNewUser(ctx context.Context, user *models.User) error {
-	span, _ := apm.StartSpan(ctx, "InsertNewUser", "repository")
-	defer span.End()
+type userRepository struct {
+	db *gorm.DB
+}
 
-	return database.DB.Create(user).Error
+// NewUserRepository returns a UserRepository storing users in db.
+func NewUserRepository(db *gorm.DB) UserRepository {
+	return &userRepository{db: db}
 }
 
-func InsertNewUserSession(ctx context.Context, session *models.UserSession) error {
-	span, _ := apm.StartSpan(ctx, "InsertNewUserSession", "repository")
+func (r *userRepository) InsertNewUser(ctx context.Context, user *models.User) error {
+	span, _ := apm.StartSpan(ctx, "InsertNewUser", "repository")
 	defer span.End()
 
-	return database.DB.Create(session).Error
+	return r.db.Create(user).Error
 }
 
-func GetUserSessionByToken(ctx context.Context, token string) (models.UserSession, error) {
-	span, _ := apm.StartSpan(ctx, "GetUserSessionByToken", "repository")
+func (r *userRepository) GetUserByUsername(ctx context.Context, username string) (models.User, error) {
+	span, _ := apm.StartSpan(ctx, "GetUserByUsername", "repository")
 	defer span.End()
 
 	var (
-		resp models.UserSession
+		resp models.User
 		err  error
 	)
-	err = database.DB.Where("token = ?", token).Last(&resp).Error
+	err = r.db.Where("username = ?", username).Last(&resp).Error
 	return resp, err
 }
 
-func DeleteUserSessionByToken(ctx context.Context, token string) error {
-	span, _ := apm.StartSpan(ctx, "DeleteUserSessionByToken", "repository")
-	defer span.End()
-
-	return database.DB.Exec("DELETE FROM user_sessions WHERE token = ?", token).Error
-}
-
-func UpdateUserSessionToken(ctx context.Context, token string, tokenExpired time.Time, refreshToken string) error {
-	span, _ := apm.StartSpan(ctx, "UpdateUserSessionToken", "repository")
-	defer span.End()
-
-	return database.DB.Exec("UPDATE user_sessions SET token = ?, token_expired=? WHERE refresh_token = ?", token, tokenExpired, refreshToken).Error
-}
-
-func GetUserByUsername(ctx context.Context, username string) (models.User, error) {
-	span, _ := apm.StartSpan(ctx, "GetUserByUsername", "repository")
+func (r *userRepository) GetUsersByUsernames(ctx context.Context, usernames []string) ([]models.User, error) {
+	span, _ := apm.StartSpan(ctx, "GetUsersByUsernames", "repository")
 	defer span.End()
 
 	var (
-		resp models.User
+		resp []models.User
 		err  error
 	)
-	err = database.DB.Where("username = ?", username).Last(&resp).Error
+	err = r.db.Where("username IN ?", usernames).Find(&resp).Error
 	return resp, err
 }
+
+func (r *userRepository) UpdateUserLastSeen(ctx context.Context, userID uint, lastSeenAt time.Time) error {
+	span, _ := apm.StartSpan(ctx, "UpdateUserLastSeen", "repository")
+	defer span.End()
+
+	return r.db.Exec("UPDATE users SET last_seen_at = ? WHERE id = ?", lastSeenAt, userID).Error
+}
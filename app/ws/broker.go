@@ -0,0 +1,162 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// BrokerMessage is a hub event fanned out to the other instances of the application.
+// Instance identifies the publishing hub, so that it can ignore its own messages when
+// the broker echoes them back. The addressing fields have the same meaning as in
+// outbound; All distinguishes a broadcast to everyone from an empty username list.
+// A message listing Sessions carries no event but asks every instance to disconnect
+// the connections of those revoked sessions.
+type BrokerMessage struct {
+	Instance  string   `json:"instance"`
+	All       bool     `json:"all,omitempty"`
+	Usernames []string `json:"usernames,omitempty"`
+	Except    string   `json:"except,omitempty"`
+	Data      []byte   `json:"data,omitempty"`
+	Legacy    []byte   `json:"legacy,omitempty"`
+	Sessions  []uint   `json:"sessions,omitempty"`
+}
+
+// Broker carries hub events between the instances of the application, so that a
+// message sent on one instance reaches the clients connected to every other instance.
+type Broker interface {
+	// Publish sends msg to every subscriber, including the ones of the publishing
+	// instance.
+	Publish(ctx context.Context, msg BrokerMessage) error
+	// Subscribe registers handler to be called for every published message until the
+	// broker is closed. Handlers may block.
+	Subscribe(handler func(BrokerMessage)) error
+	// Close stops delivering messages and releases the resources of the broker.
+	Close() error
+}
+
+// InProcessBroker is a Broker connecting the hubs of a single process. It is the
+// default when no backplane is configured, and lets several hubs share one process
+// in development.
+type InProcessBroker struct {
+	mu       sync.RWMutex
+	handlers []func(BrokerMessage)
+	closed   bool
+}
+
+// NewInProcessBroker creates a broker without subscribers.
+func NewInProcessBroker() *InProcessBroker {
+	return &InProcessBroker{}
+}
+
+// Publish calls every handler with msg on the calling goroutine.
+func (b *InProcessBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return fmt.Errorf("broker is closed")
+	}
+	for _, handler := range b.handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *InProcessBroker) Subscribe(handler func(BrokerMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return fmt.Errorf("broker is closed")
+	}
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *InProcessBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.handlers = nil
+	return nil
+}
+
+// newInstanceID returns an identifier for this process that is unique across the
+// instances sharing a broker: the host name followed by random bytes.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 6)
+	if _, err = rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return fmt.Sprintf("%s-%s", host, hex.EncodeToString(suffix))
+}
+
+// toBrokerMessage converts an outbound event addressed to several clients into the
+// message published to the other instances.
+func (h *Hub) toBrokerMessage(msg outbound) BrokerMessage {
+	return BrokerMessage{
+		Instance:  h.instanceID,
+		All:       msg.usernames == nil,
+		Usernames: msg.usernames,
+		Except:    msg.except,
+		Data:      msg.data,
+		Legacy:    msg.legacy,
+	}
+}
+
+// receive routes a message published by another instance to the local clients.
+// Messages published by this hub have already been routed and are ignored.
+func (h *Hub) receive(msg BrokerMessage) {
+	if msg.Instance == h.instanceID {
+		return
+	}
+	if len(msg.Sessions) > 0 {
+		h.revoke <- msg.Sessions
+		return
+	}
+
+	out := outbound{except: msg.Except, data: msg.Data, legacy: msg.Legacy}
+	if !msg.All {
+		out.usernames = msg.Usernames
+		if out.usernames == nil {
+			out.usernames = []string{}
+		}
+	}
+	h.broadcast <- out
+}
+
+// publish queues msg for the other instances without blocking the caller. When the
+// queue is full the message is dropped for the other instances only.
+func (h *Hub) publish(msg outbound) {
+	h.relayMessage(h.toBrokerMessage(msg))
+}
+
+// relayMessage queues msg for the broker without blocking the caller.
+func (h *Hub) relayMessage(msg BrokerMessage) {
+	select {
+	case h.relay <- msg:
+	default:
+		log.Println("broker queue is full, dropping message for other instances")
+	}
+}
+
+// publishLoop hands the queued messages to the broker one at a time.
+func (h *Hub) publishLoop() {
+	for msg := range h.relay {
+		ctx, cancel := context.WithTimeout(context.Background(), h.writeTimeout)
+		if err := h.broker.Publish(ctx, msg); err != nil {
+			log.Println("failed to publish message to broker: ", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,80 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBroker is a Broker backed by Redis Pub/Sub. Every instance subscribes to the
+// same channel, so an event published by one instance reaches all of them. Pub/Sub
+// does not store messages, instances that are disconnected from Redis miss the events
+// published in the meantime.
+type RedisBroker struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+// NewRedisBroker connects to the Redis server at url, e.g. "redis://localhost:6379/0",
+// and publishes on the given channel. It fails when the server cannot be reached.
+func NewRedisBroker(url string, channel string) (*RedisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	return &RedisBroker{client: client, channel: channel}, nil
+}
+
+func (b *RedisBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+// Subscribe subscribes to the channel and calls handler from a single goroutine for
+// every message, in the order they were published. Only one handler is supported.
+func (b *RedisBroker) Subscribe(handler func(BrokerMessage)) error {
+	if b.pubsub != nil {
+		return fmt.Errorf("redis broker is already subscribed")
+	}
+
+	pubsub := b.client.Subscribe(context.Background(), b.channel)
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to %s: %v", b.channel, err)
+	}
+	b.pubsub = pubsub
+
+	go func() {
+		for redisMsg := range pubsub.Channel() {
+			var msg BrokerMessage
+			if err := json.Unmarshal([]byte(redisMsg.Payload), &msg); err != nil {
+				log.Println("failed to decode broker message: ", err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	if b.pubsub != nil {
+		if err := b.pubsub.Close(); err != nil {
+			log.Println("failed to close redis subscription: ", err)
+		}
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,109 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// brokers returns, for every Broker implementation, a function creating the broker of
+// one instance; the brokers it creates are connected to each other.
+func brokers(t *testing.T) map[string]func() Broker {
+	return map[string]func() Broker{
+		"in-process": func() func() Broker {
+			broker := NewInProcessBroker()
+			return func() Broker { return broker }
+		}(),
+		"redis": func() func() Broker {
+			server := miniredis.RunT(t)
+			return func() Broker {
+				broker, err := NewRedisBroker("redis://"+server.Addr(), "test")
+				if err != nil {
+					t.Fatalf("NewRedisBroker: %v", err)
+				}
+				return broker
+			}
+		}(),
+	}
+}
+
+func TestBrokerFanOut(t *testing.T) {
+	for name, newBroker := range brokers(t) {
+		t.Run(name, func(t *testing.T) {
+			first := newTestHub(t, HubConfig{Broker: newBroker()})
+			second := newTestHub(t, HubConfig{Broker: newBroker()})
+			alice := connect(t, first, 1, "alice")
+			bob := connect(t, second, 2, "bob")
+
+			broadcastMessage(t, first, "from first")
+			expectMessage(t, alice, "from first")
+			expectMessage(t, bob, "from first")
+
+			if err := second.BroadcastTo([]string{"alice"}, models.EventMessageNew, models.MessagePayload{Message: "to alice"}); err != nil {
+				t.Fatalf("BroadcastTo: %v", err)
+			}
+			// The echo of the first message would arrive before this one.
+			expectMessage(t, alice, "to alice")
+
+			if err := first.BroadcastExcept("alice", models.EventMessageNew, models.MessagePayload{Message: "not alice"}); err != nil {
+				t.Fatalf("BroadcastExcept: %v", err)
+			}
+			expectMessage(t, bob, "not alice")
+		})
+	}
+}
+
+func TestBrokerIgnoresOwnMessages(t *testing.T) {
+	for name, newBroker := range brokers(t) {
+		t.Run(name, func(t *testing.T) {
+			broker := newBroker()
+			first := newTestHub(t, HubConfig{Broker: broker, InstanceID: "first"})
+			alice := connect(t, first, 1, "alice")
+
+			// The broker hands the hub its own message back, it was already delivered.
+			broadcastMessage(t, first, "once")
+			expectMessage(t, alice, "once")
+			err := broker.Publish(context.Background(), BrokerMessage{Instance: "first", All: true, Data: encodeTestMessage(t, "echo")})
+			if err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			err = broker.Publish(context.Background(), BrokerMessage{Instance: "second", All: true, Data: encodeTestMessage(t, "other")})
+			if err != nil {
+				t.Fatalf("Publish: %v", err)
+			}
+			expectMessage(t, alice, "other")
+		})
+	}
+}
+
+func TestBrokerDisconnectsRevokedSessionsEverywhere(t *testing.T) {
+	for name, newBroker := range brokers(t) {
+		t.Run(name, func(t *testing.T) {
+			first := newTestHub(t, HubConfig{Broker: newBroker()})
+			second := newTestHub(t, HubConfig{Broker: newBroker()})
+
+			alice := NewClient(second, nil, 1, "alice", 7, models.EnvelopeVersion)
+			second.Register(alice)
+			expectPresence(t, alice, "alice", models.PresenceOnline)
+
+			first.DisconnectSessions(7)
+			expectClosed(t, alice)
+			if code := alice.closeCode.Load(); code != CloseSessionRevoked {
+				t.Fatalf("got close code %d, want %d", code, CloseSessionRevoked)
+			}
+		})
+	}
+}
+
+func encodeTestMessage(t *testing.T, text string) []byte {
+	t.Helper()
+
+	out, err := encodeEvent(models.EventMessageNew, models.MessagePayload{Message: text, Date: time.Now()})
+	if err != nil {
+		t.Fatalf("encodeEvent: %v", err)
+	}
+	return out.data
+}
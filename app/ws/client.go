@@ -0,0 +1,153 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// Client is a single authenticated WebSocket connection registered in a Hub.
+type Client struct {
+	hub      *Hub
+	conn     *websocket.Conn
+	send     chan []byte
+	UserID   uint
+	Username string
+	// SessionID is the login session the connection was authenticated with, revoking
+	// the session disconnects it.
+	SessionID uint
+	// Version is the envelope version negotiated at the handshake, 0 for clients
+	// that exchange bare message payloads.
+	Version int
+
+	reaped atomic.Bool
+
+	// limiter, signalLimiter and violations are only touched by the read loop of the
+	// connection.
+	limiter       *tokenBucket
+	signalLimiter *tokenBucket
+	violations    int
+	// closeCode is the code of the close frame sent once the send queue is closed.
+	closeCode atomic.Int32
+
+	// replaying is set before a client resuming with ?since= is registered. Until its
+	// replay is delivered the hub keeps its live events in held, or only notes
+	// heldOverflow once they do not fit. They are only touched by the hub goroutine
+	// afterwards.
+	replaying    bool
+	held         [][]byte
+	heldOverflow bool
+}
+
+// NewClient wraps an upgraded connection of the given user and session speaking the
+// given envelope version. The client is not registered in the hub until Hub.Register
+// is called.
+func NewClient(hub *Hub, conn *websocket.Conn, userID uint, username string, sessionID uint, version int) *Client {
+	client := &Client{
+		hub:       hub,
+		conn:      conn,
+		send:      make(chan []byte, hub.sendBufferSize),
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		Version:   version,
+
+		limiter:       newTokenBucket(hub.rateLimit, hub.rateBurst),
+		signalLimiter: newTokenBucket(hub.signalRate, hub.signalBurst),
+	}
+	client.closeCode.Store(websocket.CloseNormalClosure)
+	return client
+}
+
+// Actor returns the user this client is authenticated as.
+func (c *Client) Actor() Actor {
+	return Actor{UserID: c.UserID, Username: c.Username}
+}
+
+// Send queues an event for this client only.
+func (c *Client) Send(eventType string, data interface{}) {
+	if err := c.hub.SendTo(c, eventType, data); err != nil {
+		log.Printf("failed to send %s to %s: %v", eventType, c.Username, err)
+	}
+}
+
+// SendError reports a failed event back to this client. ref is the ID of the event
+// that failed, if the client gave it one.
+func (c *Client) SendError(ref string, err *EventError) {
+	c.Send(models.EventError, models.ErrorPayload{Ref: ref, Code: err.Code, Message: err.Message})
+}
+
+// frame returns the encoding of out matching the client's protocol version, or nil
+// when the event cannot be expressed in that version.
+func (c *Client) frame(out outbound) []byte {
+	if c.Version < models.EnvelopeVersion {
+		return out.legacy
+	}
+	return out.data
+}
+
+// writePump is the only goroutine that writes to the connection. It drains the send
+// queue until the hub closes it, then sends a close frame, and pings the peer every
+// ping interval in between. Every write must finish within the write timeout. After a
+// write error it closes the connection, which ends the read loop, and keeps draining
+// so that the hub never blocks on this client.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeTimeout))
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(int(c.closeCode.Load()), ""))
+				c.conn.Close()
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.closeAfterWriteError(err)
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.closeAfterWriteError(err)
+				return
+			}
+		}
+	}
+}
+
+// closeAfterWriteError closes the connection after a failed write and drains the send
+// queue until the hub closes it. A write that timed out means the peer is gone, so the
+// connection is counted as reaped.
+func (c *Client) closeAfterWriteError(err error) {
+	if isTimeout(err) {
+		c.reap("write timed out")
+	} else {
+		log.Println("Failed to write message: ", err)
+		c.conn.Close()
+	}
+	for range c.send {
+	}
+}
+
+// reap closes a connection whose peer stopped responding and counts it in the hub
+// metrics. Only the first call for a client counts.
+func (c *Client) reap(reason string) {
+	if c.reaped.CompareAndSwap(false, true) {
+		c.hub.reaped.Add(1)
+		log.Printf("reaping connection of %s: %s", c.Username, reason)
+	}
+	c.conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
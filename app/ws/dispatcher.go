@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+)
+
+// HandlerFunc handles one event received from a client. Returning an *EventError
+// answers the client with an error event carrying its code, any other error is
+// logged and answered with an internal error.
+type HandlerFunc func(ctx context.Context, client *Client, env models.Envelope) error
+
+// EventError is an error caused by the event a client sent, reported back to that
+// client as an error event.
+type EventError struct {
+	Code    string
+	Message string
+}
+
+func (e *EventError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewEventError creates an EventError with the given code and formatted message.
+func NewEventError(code string, format string, args ...interface{}) *EventError {
+	return &EventError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Dispatcher routes events received from clients to the handler registered for
+// their type.
+type Dispatcher struct {
+	handlers map[string]HandlerFunc
+}
+
+// NewDispatcher creates a dispatcher without any handlers.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler for an event type, replacing any previous one.
+func (d *Dispatcher) Handle(eventType string, handler HandlerFunc) {
+	d.handlers[eventType] = handler
+}
+
+// Dispatch runs the handler of the event inside an APM transaction named after the
+// event type and reports failures to the client as error events. Events without a
+// registered handler are answered with an unsupported_event error. Rate and length
+// violations are counted on the client.
+func (d *Dispatcher) Dispatch(client *Client, env models.Envelope) {
+	handler, ok := d.handlers[env.Type]
+	if !ok {
+		client.SendError(env.ID, NewEventError(models.ErrorCodeUnsupportedEvent, "unsupported event %q", env.Type))
+		return
+	}
+
+	tx := apm.DefaultTracer.StartTransaction(env.Type, "ws")
+	defer tx.End()
+	ctx := apm.ContextWithTransaction(context.Background(), tx)
+
+	err := handler(ctx, client, env)
+	if err == nil {
+		return
+	}
+
+	eventErr, ok := err.(*EventError)
+	if !ok {
+		log.Printf("failed to handle %s from %s: %v", env.Type, client.Username, err)
+		eventErr = NewEventError(models.ErrorCodeInternal, "internal server error")
+	}
+	if isViolation(eventErr) {
+		client.violations++
+	}
+	client.SendError(env.ID, eventErr)
+}
@@ -0,0 +1,199 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// handleMessageSend stores a message sent by the client, acknowledges it to the
+// sender and delivers it as message.new. Messages without a room or recipient go to
+// every connected client, room messages are only accepted from members of the room
+// and only reach the members' connections, and direct messages only reach the
+// connections of the two participants. A message with reply_to joins the thread of
+// that message, taking over its conversation, and the thread participants are told
+// with a thread.reply event.
+func handleMessageSend(ctx context.Context, client *Client, env models.Envelope) error {
+	var req models.MessagePayload
+	if err := json.Unmarshal(env.Data, &req); err != nil {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid message: %v", err)
+	}
+
+	// Only the fields a client is allowed to choose are taken from the request. The date
+	// is stored with the millisecond precision of MongoDB, which history cursors use.
+	msg := models.MessagePayload{
+		ClientMsgID: req.ClientMsgID,
+		Type:        req.Type,
+		From:        client.Username,
+		Message:     req.Message,
+		Date:        time.Now().Truncate(time.Millisecond),
+		RoomID:      req.RoomID,
+		To:          req.To,
+	}
+	if msg.Type == "" {
+		msg.Type = models.MessageTypeText
+	}
+	if msg.Type != models.MessageTypeText {
+		return NewEventError(models.ErrorCodeBadRequest, "unsupported message type %q", msg.Type)
+	}
+	if err := checkMessageLength(client.hub, msg.Message); err != nil {
+		return err
+	}
+
+	if req.ReplyTo != nil {
+		if err := joinThread(ctx, client, &msg, req.ReplyTo.Hex()); err != nil {
+			return err
+		}
+	}
+
+	recipients, conversationID, err := resolveConversation(ctx, client, msg.RoomID, msg.To)
+	if err != nil {
+		return err
+	}
+	msg.ConversationID = conversationID
+
+	msg, duplicate, err := client.hub.repos.Messages.InsertNewMessage(ctx, msg)
+	if err != nil {
+		return err
+	}
+	client.hub.typing.stop(typingKey{client: client, conversation: typingConversation(models.TypingPayload{RoomID: msg.RoomID, To: msg.To})})
+	client.Send(models.EventAck, models.AckPayload{Ref: env.ID, MessageID: msg.ID.Hex()})
+
+	// A retried send is answered with the stored message, but only to the sender.
+	if duplicate {
+		client.Send(models.EventMessageNew, msg)
+		return nil
+	}
+	if recipients == nil {
+		err = client.hub.Broadcast(models.EventMessageNew, msg)
+	} else {
+		err = client.hub.BroadcastTo(recipients, models.EventMessageNew, msg)
+	}
+	if err != nil || msg.ThreadRoot == nil {
+		return err
+	}
+	return notifyThread(ctx, client.hub, msg, recipients)
+}
+
+// joinThread makes msg a reply to the message with the given ID. The reply belongs to
+// the thread of its parent and to the parent's conversation; naming a different room or
+// recipient is rejected.
+func joinThread(ctx context.Context, client *Client, msg *models.MessagePayload, parentID string) error {
+	parent, err := GetAccessibleMessage(ctx, client.hub, client.Actor(), parentID)
+	if err != nil {
+		return err
+	}
+
+	to := ""
+	if parent.ConversationID != "" {
+		to = parent.To
+		if parent.To == client.Username {
+			to = parent.From
+		}
+	}
+	if (msg.RoomID != 0 && msg.RoomID != parent.RoomID) || (msg.To != "" && msg.To != to) {
+		return NewEventError(models.ErrorCodeBadRequest, "a reply must stay in the conversation of its parent")
+	}
+	msg.RoomID = parent.RoomID
+	msg.To = to
+
+	root := parent.ID
+	if parent.ThreadRoot != nil {
+		root = *parent.ThreadRoot
+	}
+	msg.ReplyTo = &parent.ID
+	msg.ThreadRoot = &root
+	return nil
+}
+
+// notifyThread updates the counters of the thread root of a new reply and sends
+// thread.reply to the thread participants, which are the root author and everyone who
+// replied. For rooms, recipients restricts the notification to current members.
+func notifyThread(ctx context.Context, hub *Hub, reply models.MessagePayload, recipients []string) error {
+	root, err := hub.repos.Messages.UpdateThreadRoot(ctx, *reply.ThreadRoot, reply.From, reply.Date)
+	if err != nil {
+		return fmt.Errorf("failed to update thread root: %v", err)
+	}
+
+	participants := append([]string{root.From}, root.ThreadParticipants...)
+	if recipients != nil {
+		members := make(map[string]bool, len(recipients))
+		for _, recipient := range recipients {
+			members[recipient] = true
+		}
+		allowed := participants[:0]
+		for _, participant := range participants {
+			if members[participant] {
+				allowed = append(allowed, participant)
+			}
+		}
+		participants = allowed
+	}
+
+	return hub.BroadcastTo(uniqueUsernames(participants), models.EventThreadReply, models.ThreadReplyPayload{
+		RootID:      root.ID.Hex(),
+		ReplyCount:  root.ReplyCount,
+		LastReplyAt: root.LastReplyAt,
+		Message:     reply,
+	})
+}
+
+// uniqueUsernames removes repeated usernames while keeping their order.
+func uniqueUsernames(usernames []string) []string {
+	seen := make(map[string]bool, len(usernames))
+	resp := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		if !seen[username] {
+			seen[username] = true
+			resp = append(resp, username)
+		}
+	}
+	return resp
+}
+
+// handlePing answers a ping with a pong echoing the ping's payload.
+func handlePing(ctx context.Context, client *Client, env models.Envelope) error {
+	client.Send(models.EventPong, env.Data)
+	return nil
+}
+
+// resolveConversation checks that the client may post to the conversation identified
+// by a room ID or a recipient username, and returns the usernames to deliver to
+// together with the direct conversation ID, if any. A nil recipient list means the
+// global channel, which reaches every connected client.
+func resolveConversation(ctx context.Context, client *Client, roomID uint, to string) ([]string, string, error) {
+	switch {
+	case roomID != 0 && to != "":
+		return nil, "", NewEventError(models.ErrorCodeBadRequest, "a message cannot have both a room and a recipient")
+	case roomID != 0:
+		isMember, err := client.hub.repos.Rooms.IsRoomMember(ctx, roomID, client.UserID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to check room membership: %v", err)
+		}
+		if !isMember {
+			return nil, "", NewEventError(models.ErrorCodeForbidden, "not a member of room %d", roomID)
+		}
+
+		recipients, err := client.hub.repos.Rooms.GetRoomMemberUsernames(ctx, roomID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get room members: %v", err)
+		}
+		return recipients, "", nil
+	case to != "":
+		recipient, err := client.hub.repos.Users.GetUserByUsername(ctx, to)
+		if err != nil {
+			return nil, "", NewEventError(models.ErrorCodeNotFound, "user %s not found", to)
+		}
+
+		recipients := []string{client.Username}
+		if recipient.Username != client.Username {
+			recipients = append(recipients, recipient.Username)
+		}
+		return recipients, models.DirectConversationID(client.UserID, recipient.ID), nil
+	default:
+		return nil, "", nil
+	}
+}
@@ -0,0 +1,696 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/pkg/env"
+)
+
+// SlowConsumerPolicy decides what the hub does with a client whose send queue is
+// full when a new message has to be delivered to it.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDrop skips the message for that client only.
+	SlowConsumerDrop SlowConsumerPolicy = "drop"
+	// SlowConsumerDisconnect unregisters the client and closes its connection.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+	// SlowConsumerBlock waits until the client has room in its queue, slowing
+	// down delivery for every other client in the meantime.
+	SlowConsumerBlock SlowConsumerPolicy = "block"
+)
+
+const (
+	defaultSendBufferSize = 256
+	defaultTypingThrottle = 2 * time.Second
+	defaultTypingTimeout  = 5 * time.Second
+	defaultReplayLimit    = 100
+	defaultPingInterval   = 30 * time.Second
+	defaultPongTimeout    = 60 * time.Second
+	defaultWriteTimeout   = 10 * time.Second
+	defaultRateLimit      = 5
+	defaultRateBurst      = 10
+	defaultSignalRate     = 20
+	defaultSignalBurst    = 100
+	defaultMaxFrameSize   = 32 * 1024
+	defaultMaxMessageLen  = 4000
+	defaultMaxViolations  = 5
+	defaultRelayBuffer    = 1024
+	defaultPresenceTTL    = 30 * time.Second
+	defaultBrokerChannel  = "langchatto:ws"
+)
+
+// CloseSessionRevoked is the close code sent to connections whose login session was
+// revoked. Clients should not reconnect with the same token after receiving it.
+const CloseSessionRevoked = 4001
+
+// CloseReplayGap is the close code sent to clients without envelope support that
+// resumed with ?since= after missing more messages than are replayed. They should
+// refetch the history and reconnect without since.
+const CloseReplayGap = 4002
+
+// Backplanes selectable with WS_BROKER.
+const (
+	BrokerInProcess = "memory"
+	BrokerRedis     = "redis"
+)
+
+// HubConfig holds the tunables of a Hub. Zero values are replaced by defaults.
+type HubConfig struct {
+	// SlowConsumerPolicy decides what happens to clients whose send queue is full.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// SendBufferSize is the number of messages queued per client.
+	SendBufferSize int
+	// TypingThrottle is the minimum interval between two typing events fanned out
+	// for the same client and conversation.
+	TypingThrottle time.Duration
+	// TypingTimeout is how long a typing indicator stays active without being
+	// refreshed by another typing.start.
+	TypingTimeout time.Duration
+	// ReplayLimit is the maximum number of missed messages replayed to a client
+	// resuming with ?since=, larger gaps are answered with replay.gap instead. It is
+	// at most half of SendBufferSize, the other half holds the live events arriving
+	// during the replay.
+	ReplayLimit int
+	// PingInterval is how often the server pings every connection.
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may stay silent, neither answering a ping
+	// nor sending anything, before it is reaped. It must be longer than PingInterval.
+	PongTimeout time.Duration
+	// WriteTimeout is how long a single write to a connection may take before the
+	// connection is reaped.
+	WriteTimeout time.Duration
+	// RateLimit is the number of chat events per second a connection may send on
+	// average and RateBurst the number it may send at once.
+	RateLimit int
+	RateBurst int
+	// SignalRateLimit and SignalRateBurst limit the typing, ack and read events of a
+	// connection in the same way. They are cheaper and sent more often than chat
+	// events, e.g. a resumed client acknowledges every replayed message at once.
+	SignalRateLimit int
+	SignalRateBurst int
+	// MaxFrameSize is the largest frame in bytes a client may send, larger frames
+	// close the connection.
+	MaxFrameSize int64
+	// MaxMessageLength is the longest message text in characters.
+	MaxMessageLength int
+	// MaxViolations is the number of rate and length violations after which a
+	// connection is closed.
+	MaxViolations int
+	// Broker fans events out to the other instances of the application. Without a
+	// broker the hub uses an InProcessBroker, which only reaches hubs of the same
+	// process.
+	Broker Broker
+	// InstanceID identifies this hub on the broker. It is generated when empty.
+	InstanceID string
+	// Presence tracks the users connected to every instance. Without a store the hub
+	// uses an InProcessPresenceStore, which only knows the hubs of the same process.
+	Presence PresenceStore
+	// PresenceTTL is how long the presence store keeps the connections of an instance
+	// that stopped refreshing them, the hub refreshes them every third of it.
+	PresenceTTL time.Duration
+	// Repositories store the messages, rooms and users the hub works with.
+	Repositories repository.Repositories
+}
+
+// Metrics is a snapshot of the connection counters of a Hub.
+type Metrics struct {
+	// ActiveConnections is the number of currently registered clients.
+	ActiveConnections int64 `json:"active_connections"`
+	// AcceptedConnections is the number of clients registered since startup.
+	AcceptedConnections int64 `json:"accepted_connections"`
+	// ReapedConnections is the number of connections closed since startup because
+	// the peer stopped answering pings or a write timed out.
+	ReapedConnections int64 `json:"reaped_connections"`
+}
+
+// outbound is an encoded event waiting to be delivered by the hub. It is addressed to
+// a single client when client is set, to every connection of the listed users when
+// usernames is not nil, and otherwise to every connected client except those of the
+// user named by except. data holds the versioned envelope and legacy the bare payload
+// for clients that did not opt in to envelopes; events without a legacy encoding are
+// not delivered to those clients. An outbound carrying a replay finishes the replay of
+// client instead.
+type outbound struct {
+	client    *Client
+	usernames []string
+	except    string
+	data      []byte
+	legacy    []byte
+	replay    *replayBatch
+}
+
+// Hub owns the set of connected clients. All mutations of the set happen on the
+// goroutine running Run, other goroutines talk to it through the register, unregister,
+// broadcast and revoke channels. The per-user index is additionally guarded by usersMu
+// so that the presence refresh can read it from another goroutine.
+type Hub struct {
+	clients    map[*Client]bool
+	users      map[string]map[*Client]bool
+	usersMu    sync.RWMutex
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan outbound
+	revoke     chan []uint
+	shutdown   chan chan struct{}
+
+	// closing is set once Shutdown started, connections registering afterwards are
+	// closed right away. It is only used on the hub goroutine.
+	closing bool
+	// connections tracks the running connection handlers and pending the background
+	// writes started by the hub, so that Shutdown can wait for them. stopping is set
+	// under connectionsMu before Shutdown waits, so that no handler is added to
+	// connections during the wait.
+	connections   sync.WaitGroup
+	connectionsMu sync.Mutex
+	stopping      bool
+	pending       sync.WaitGroup
+
+	policy         SlowConsumerPolicy
+	sendBufferSize int
+	replayLimit    int
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+	writeTimeout   time.Duration
+	rateLimit      int
+	rateBurst      int
+	signalRate     int
+	signalBurst    int
+	maxFrameSize   int64
+	maxMessageLen  int
+	maxViolations  int
+	typing         *typingTracker
+	broker         Broker
+	instanceID     string
+	repos          repository.Repositories
+	relay          chan BrokerMessage
+	presence       PresenceStore
+	presenceTTL    time.Duration
+
+	// closed is closed once Shutdown is done.
+	closed chan struct{}
+
+	active   atomic.Int64
+	accepted atomic.Int64
+	reaped   atomic.Int64
+
+	// presenceChanges collects the users that came online or went offline on this
+	// instance while handling one hub event. Once the event is done they are moved to
+	// presenceQueue, which presenceLoop drains.
+	presenceChanges []presenceChange
+	presenceMu      sync.Mutex
+	presenceQueue   []presenceChange
+	presenceSignal  chan struct{}
+}
+
+// NewHub creates a hub with the given configuration and subscribes it to the broker.
+func NewHub(cfg HubConfig) (*Hub, error) {
+	switch cfg.SlowConsumerPolicy {
+	case SlowConsumerDrop, SlowConsumerDisconnect, SlowConsumerBlock:
+	default:
+		log.Printf("unknown slow consumer policy %q, falling back to %q", cfg.SlowConsumerPolicy, SlowConsumerDisconnect)
+		cfg.SlowConsumerPolicy = SlowConsumerDisconnect
+	}
+	if cfg.SendBufferSize <= 0 {
+		cfg.SendBufferSize = defaultSendBufferSize
+	}
+	if cfg.TypingThrottle <= 0 {
+		cfg.TypingThrottle = defaultTypingThrottle
+	}
+	if cfg.TypingTimeout <= 0 {
+		cfg.TypingTimeout = defaultTypingTimeout
+	}
+	if cfg.ReplayLimit <= 0 {
+		cfg.ReplayLimit = defaultReplayLimit
+	}
+	if half := cfg.SendBufferSize / 2; cfg.ReplayLimit > half && half > 0 {
+		log.Printf("replay limit %d does not fit the send buffer of %d, using %d", cfg.ReplayLimit, cfg.SendBufferSize, half)
+		cfg.ReplayLimit = half
+	}
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.PongTimeout <= cfg.PingInterval {
+		log.Printf("pong timeout %s is not longer than the ping interval %s, using %s", cfg.PongTimeout, cfg.PingInterval, 2*cfg.PingInterval)
+		cfg.PongTimeout = 2 * cfg.PingInterval
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.RateLimit <= 0 {
+		cfg.RateLimit = defaultRateLimit
+	}
+	if cfg.RateBurst <= 0 {
+		cfg.RateBurst = defaultRateBurst
+	}
+	if cfg.SignalRateLimit <= 0 {
+		cfg.SignalRateLimit = defaultSignalRate
+	}
+	if cfg.SignalRateBurst <= 0 {
+		cfg.SignalRateBurst = defaultSignalBurst
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = defaultMaxFrameSize
+	}
+	if cfg.MaxMessageLength <= 0 {
+		cfg.MaxMessageLength = defaultMaxMessageLen
+	}
+	if cfg.MaxViolations <= 0 {
+		cfg.MaxViolations = defaultMaxViolations
+	}
+	if cfg.Broker == nil {
+		cfg.Broker = NewInProcessBroker()
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = newInstanceID()
+	}
+	if cfg.Presence == nil {
+		cfg.Presence = NewInProcessPresenceStore()
+	}
+	if cfg.PresenceTTL <= 0 {
+		cfg.PresenceTTL = defaultPresenceTTL
+	}
+
+	h := &Hub{
+		clients:        make(map[*Client]bool),
+		users:          make(map[string]map[*Client]bool),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		broadcast:      make(chan outbound),
+		revoke:         make(chan []uint),
+		shutdown:       make(chan chan struct{}),
+		policy:         cfg.SlowConsumerPolicy,
+		sendBufferSize: cfg.SendBufferSize,
+		replayLimit:    cfg.ReplayLimit,
+		pingInterval:   cfg.PingInterval,
+		pongTimeout:    cfg.PongTimeout,
+		writeTimeout:   cfg.WriteTimeout,
+		rateLimit:      cfg.RateLimit,
+		rateBurst:      cfg.RateBurst,
+		signalRate:     cfg.SignalRateLimit,
+		signalBurst:    cfg.SignalRateBurst,
+		maxFrameSize:   cfg.MaxFrameSize,
+		maxMessageLen:  cfg.MaxMessageLength,
+		maxViolations:  cfg.MaxViolations,
+		broker:         cfg.Broker,
+		instanceID:     cfg.InstanceID,
+		repos:          cfg.Repositories,
+		relay:          make(chan BrokerMessage, defaultRelayBuffer),
+		presence:       cfg.Presence,
+		presenceTTL:    cfg.PresenceTTL,
+		closed:         make(chan struct{}),
+		presenceSignal: make(chan struct{}, 1),
+	}
+	h.typing = newTypingTracker(h, cfg.TypingThrottle, cfg.TypingTimeout)
+
+	if err := h.broker.Subscribe(h.receive); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to broker: %v", err)
+	}
+	return h, nil
+}
+
+// NewHubFromEnv creates a hub using repos and configured by the WS_SLOW_CONSUMER_POLICY
+// (drop, disconnect or block), WS_SEND_BUFFER, WS_TYPING_THROTTLE,
+// WS_TYPING_TIMEOUT, WS_REPLAY_LIMIT, WS_PING_INTERVAL, WS_PONG_TIMEOUT,
+// WS_WRITE_TIMEOUT, WS_RATE_LIMIT, WS_RATE_BURST, WS_MAX_FRAME_SIZE,
+// WS_MAX_MESSAGE_LENGTH, WS_MAX_VIOLATIONS and WS_PRESENCE_TTL environment variables.
+// Durations use time.ParseDuration syntax, e.g. "2s". WS_BROKER selects the backplane,
+// memory (the default) or redis; the Redis broker connects to REDIS_URL and publishes
+// on WS_BROKER_CHANNEL, and presence is then kept in Redis under keys starting with
+// the channel name. INSTANCE_ID overrides the generated instance ID.
+func NewHubFromEnv(repos repository.Repositories) (*Hub, error) {
+	var (
+		broker      Broker
+		presence    PresenceStore
+		presenceTTL = env.GetDuration("WS_PRESENCE_TTL", defaultPresenceTTL)
+	)
+	switch kind := env.GetEnv("WS_BROKER", BrokerInProcess); kind {
+	case BrokerInProcess:
+		broker = NewInProcessBroker()
+		presence = NewInProcessPresenceStore()
+	case BrokerRedis:
+		url := env.GetEnv("REDIS_URL", "redis://localhost:6379/0")
+		channel := env.GetEnv("WS_BROKER_CHANNEL", defaultBrokerChannel)
+		redisBroker, err := NewRedisBroker(url, channel)
+		if err != nil {
+			return nil, err
+		}
+		redisPresence, err := NewRedisPresenceStore(url, channel, presenceTTL)
+		if err != nil {
+			redisBroker.Close()
+			return nil, err
+		}
+		broker, presence = redisBroker, redisPresence
+	default:
+		return nil, fmt.Errorf("unknown broker %q", kind)
+	}
+
+	return NewHub(HubConfig{
+		SlowConsumerPolicy: SlowConsumerPolicy(env.GetEnv("WS_SLOW_CONSUMER_POLICY", string(SlowConsumerDisconnect))),
+		SendBufferSize:     env.GetInt("WS_SEND_BUFFER", defaultSendBufferSize),
+		TypingThrottle:     env.GetDuration("WS_TYPING_THROTTLE", defaultTypingThrottle),
+		TypingTimeout:      env.GetDuration("WS_TYPING_TIMEOUT", defaultTypingTimeout),
+		ReplayLimit:        env.GetInt("WS_REPLAY_LIMIT", defaultReplayLimit),
+		PingInterval:       env.GetDuration("WS_PING_INTERVAL", defaultPingInterval),
+		PongTimeout:        env.GetDuration("WS_PONG_TIMEOUT", defaultPongTimeout),
+		WriteTimeout:       env.GetDuration("WS_WRITE_TIMEOUT", defaultWriteTimeout),
+		RateLimit:          env.GetInt("WS_RATE_LIMIT", defaultRateLimit),
+		RateBurst:          env.GetInt("WS_RATE_BURST", defaultRateBurst),
+		SignalRateLimit:    env.GetInt("WS_SIGNAL_RATE_LIMIT", defaultSignalRate),
+		SignalRateBurst:    env.GetInt("WS_SIGNAL_RATE_BURST", defaultSignalBurst),
+		MaxFrameSize:       int64(env.GetInt("WS_MAX_FRAME_SIZE", defaultMaxFrameSize)),
+		MaxMessageLength:   env.GetInt("WS_MAX_MESSAGE_LENGTH", defaultMaxMessageLen),
+		MaxViolations:      env.GetInt("WS_MAX_VIOLATIONS", defaultMaxViolations),
+		Broker:             broker,
+		InstanceID:         env.GetEnv("INSTANCE_ID", ""),
+		Presence:           presence,
+		PresenceTTL:        presenceTTL,
+		Repositories:       repos,
+	})
+}
+
+// Run processes registrations, unregistrations and broadcasts until the process
+// exits. It must be started exactly once per hub.
+func (h *Hub) Run() {
+	go h.publishLoop()
+	go h.presenceLoop()
+	go h.refreshPresence()
+
+	for {
+		select {
+		case client := <-h.register:
+			if h.closing {
+				client.closeCode.Store(websocket.CloseGoingAway)
+				close(client.send)
+				continue
+			}
+			h.add(client)
+		case client := <-h.unregister:
+			h.remove(client)
+		case msg := <-h.broadcast:
+			h.route(msg)
+		case sessionIDs := <-h.revoke:
+			h.disconnectSessions(sessionIDs)
+		case done := <-h.shutdown:
+			h.closing = true
+			for client := range h.clients {
+				client.closeCode.Store(websocket.CloseGoingAway)
+				h.remove(client)
+			}
+			h.flushPresence()
+			close(done)
+		}
+		h.flushPresence()
+	}
+}
+
+// Shutdown closes every connection with a going away close frame, refuses new ones
+// and waits until the connection handlers have returned and the disconnected users are
+// recorded in the presence store, or until ctx is done, and closes the broker and the
+// presence store. It should be called after the listeners are closed; connections
+// still upgraded afterwards are closed right away. The hub keeps running so that
+// events still in flight do not block their senders.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.connectionsMu.Lock()
+	h.stopping = true
+	h.connectionsMu.Unlock()
+
+	done := make(chan struct{})
+	select {
+	case h.shutdown <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+
+	if err := waitGroup(ctx, &h.connections); err != nil {
+		return err
+	}
+	if err := waitGroup(ctx, &h.pending); err != nil {
+		return err
+	}
+	close(h.closed)
+	if err := h.presence.Close(); err != nil {
+		log.Println("failed to close presence store: ", err)
+	}
+	return h.broker.Close()
+}
+
+// trackConnection counts a connection handler in, so that Shutdown waits for it. It
+// reports false once Shutdown started, the handler must then close the connection
+// without registering a client.
+func (h *Hub) trackConnection() bool {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	if h.stopping {
+		return false
+	}
+	h.connections.Add(1)
+	return true
+}
+
+// waitGroup waits for wg or until ctx is done, whichever happens first.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// route delivers msg to the clients it is addressed to.
+func (h *Hub) route(msg outbound) {
+	if msg.client != nil {
+		if msg.replay != nil {
+			h.finishReplay(msg.client, msg.replay)
+		} else if h.clients[msg.client] {
+			h.deliver(msg.client, msg)
+		}
+		return
+	}
+	if msg.usernames == nil {
+		for client := range h.clients {
+			if msg.except == "" || client.Username != msg.except {
+				h.deliver(client, msg)
+			}
+		}
+		return
+	}
+	for _, username := range msg.usernames {
+		for client := range h.users[username] {
+			h.deliver(client, msg)
+		}
+	}
+}
+
+// Register adds the client to the hub so it receives broadcasts.
+func (h *Hub) Register(client *Client) {
+	h.register <- client
+}
+
+// Unregister removes the client from the hub and closes its send queue. It is safe
+// to call more than once for the same client.
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Broadcast encodes an event once and queues it for every registered client, here
+// and on the other instances.
+func (h *Hub) Broadcast(eventType string, data interface{}) error {
+	msg, err := encodeEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+	h.broadcast <- msg
+	h.publish(msg)
+	return nil
+}
+
+// BroadcastExcept encodes an event once and queues it for every registered client,
+// here and on the other instances, except the connections of the given user.
+func (h *Hub) BroadcastExcept(username string, eventType string, data interface{}) error {
+	msg, err := encodeEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+	msg.except = username
+	h.broadcast <- msg
+	h.publish(msg)
+	return nil
+}
+
+// BroadcastTo encodes an event once and queues it for every connection of the given
+// users, here and on the other instances. Users without a live connection are skipped.
+func (h *Hub) BroadcastTo(usernames []string, eventType string, data interface{}) error {
+	msg, err := encodeEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+	msg.usernames = usernames
+	if msg.usernames == nil {
+		msg.usernames = []string{}
+	}
+	h.broadcast <- msg
+	h.publish(msg)
+	return nil
+}
+
+// SendTo encodes an event and queues it for a single local client. It is a no-op
+// when the client has already been unregistered.
+func (h *Hub) SendTo(client *Client, eventType string, data interface{}) error {
+	msg, err := encodeEvent(eventType, data)
+	if err != nil {
+		return err
+	}
+	msg.client = client
+	h.broadcast <- msg
+	return nil
+}
+
+// encodeEvent encodes data as an envelope of the given type and, for new messages,
+// also as the bare payload understood by clients without envelope support.
+func encodeEvent(eventType string, data interface{}) (outbound, error) {
+	env, err := models.NewEnvelope(eventType, data)
+	if err != nil {
+		return outbound{}, err
+	}
+
+	msg := outbound{}
+	if msg.data, err = json.Marshal(env); err != nil {
+		return outbound{}, err
+	}
+	if eventType == models.EventMessageNew {
+		msg.legacy = env.Data
+	}
+	return msg, nil
+}
+
+// deliver queues the encoding of msg matching the client's protocol version for the
+// client, or holds it back while the client's replay is not delivered yet.
+func (h *Hub) deliver(client *Client, out outbound) {
+	msg := client.frame(out)
+	if msg == nil {
+		return
+	}
+	if client.replaying {
+		h.holdBack(client, msg)
+		return
+	}
+	h.enqueue(client, msg)
+}
+
+// enqueue puts msg on the client's send channel, applying the slow consumer policy when
+// the queue is full. Clients removed in the meantime are skipped.
+func (h *Hub) enqueue(client *Client, msg []byte) {
+	if !h.clients[client] {
+		return
+	}
+
+	if h.policy == SlowConsumerBlock {
+		client.send <- msg
+		return
+	}
+
+	select {
+	case client.send <- msg:
+	default:
+		if h.policy == SlowConsumerDrop {
+			log.Printf("send queue of %s is full, dropping message", client.Username)
+			return
+		}
+		log.Printf("send queue of %s is full, disconnecting", client.Username)
+		h.remove(client)
+	}
+}
+
+// DisconnectSessions closes the connections authenticated with the given sessions, here
+// and on the other instances, with a CloseSessionRevoked close frame. It is called
+// after the sessions were revoked.
+func (h *Hub) DisconnectSessions(sessionIDs ...uint) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	h.revoke <- sessionIDs
+	h.relayMessage(BrokerMessage{Instance: h.instanceID, Sessions: sessionIDs})
+}
+
+// disconnectSessions removes the local clients of the given sessions.
+func (h *Hub) disconnectSessions(sessionIDs []uint) {
+	revoked := make(map[uint]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+	for client := range h.clients {
+		if revoked[client.SessionID] {
+			log.Printf("session %d of %s was revoked, disconnecting", client.SessionID, client.Username)
+			client.closeCode.Store(CloseSessionRevoked)
+			h.remove(client)
+		}
+	}
+}
+
+// Metrics returns the current connection counters. It is safe to call from any
+// goroutine.
+func (h *Hub) Metrics() Metrics {
+	return Metrics{
+		ActiveConnections:   h.active.Load(),
+		AcceptedConnections: h.accepted.Load(),
+		ReapedConnections:   h.reaped.Load(),
+	}
+}
+
+func (h *Hub) add(client *Client) {
+	h.clients[client] = true
+	h.active.Add(1)
+	h.accepted.Add(1)
+
+	h.usersMu.Lock()
+	if h.users[client.Username] == nil {
+		h.users[client.Username] = make(map[*Client]bool)
+	}
+	h.users[client.Username][client] = true
+	first := len(h.users[client.Username]) == 1
+	h.usersMu.Unlock()
+
+	if first {
+		h.presenceChanges = append(h.presenceChanges, presenceChange{client: client, online: true, at: time.Now()})
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	close(client.send)
+	h.active.Add(-1)
+
+	h.usersMu.Lock()
+	delete(h.users[client.Username], client)
+	last := len(h.users[client.Username]) == 0
+	if last {
+		delete(h.users, client.Username)
+	}
+	h.usersMu.Unlock()
+
+	if last {
+		h.presenceChanges = append(h.presenceChanges, presenceChange{client: client, online: false, at: time.Now()})
+	}
+}
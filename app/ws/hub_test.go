@@ -0,0 +1,334 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
+)
+
+const testTimeout = 2 * time.Second
+
+func newTestHub(t *testing.T, cfg HubConfig) *Hub {
+	t.Helper()
+
+	if cfg.Repositories.Users == nil {
+		cfg.Repositories = repository.NewMemoryRepositories()
+	}
+	hub, err := NewHub(cfg)
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return hub
+}
+
+// connect registers a client of username without a connection and waits until the
+// hub announced it, so that no presence event is in flight afterwards.
+func connect(t *testing.T, hub *Hub, userID uint, username string) *Client {
+	t.Helper()
+
+	client := NewClient(hub, nil, userID, username, 0, models.EnvelopeVersion)
+	hub.Register(client)
+	expectPresence(t, client, username, models.PresenceOnline)
+	return client
+}
+
+// nextEvent returns the next event queued for client.
+func nextEvent(t *testing.T, client *Client) models.Envelope {
+	t.Helper()
+
+	select {
+	case msg, ok := <-client.send:
+		if !ok {
+			t.Fatalf("send queue of %s was closed", client.Username)
+		}
+		var env models.Envelope
+		if err := json.Unmarshal(msg, &env); err != nil {
+			t.Fatalf("failed to decode event: %v", err)
+		}
+		return env
+	case <-time.After(testTimeout):
+		t.Fatalf("no event for %s", client.Username)
+	}
+	return models.Envelope{}
+}
+
+// expectEvent skips the events queued for client until one of eventType arrives.
+func expectEvent(t *testing.T, client *Client, eventType string) models.Envelope {
+	t.Helper()
+
+	for {
+		if env := nextEvent(t, client); env.Type == eventType {
+			return env
+		}
+	}
+}
+
+func expectPresence(t *testing.T, client *Client, username string, status string) {
+	t.Helper()
+
+	for {
+		var payload models.PresencePayload
+		env := expectEvent(t, client, models.EventPresence)
+		if err := json.Unmarshal(env.Data, &payload); err != nil {
+			t.Fatalf("failed to decode presence: %v", err)
+		}
+		if payload.Username == username && payload.Status == status {
+			return
+		}
+	}
+}
+
+func expectMessage(t *testing.T, client *Client, text string) {
+	t.Helper()
+
+	var msg models.MessagePayload
+	env := expectEvent(t, client, models.EventMessageNew)
+	if err := json.Unmarshal(env.Data, &msg); err != nil {
+		t.Fatalf("failed to decode message: %v", err)
+	}
+	if msg.Message != text {
+		t.Fatalf("got message %q, want %q", msg.Message, text)
+	}
+}
+
+func expectClosed(t *testing.T, client *Client) {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-client.send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("send queue of %s was not closed", client.Username)
+		}
+	}
+}
+
+func broadcastMessage(t *testing.T, hub *Hub, text string) {
+	t.Helper()
+
+	if err := hub.Broadcast(models.EventMessageNew, models.MessagePayload{From: "alice", Message: text}); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+}
+
+// waitIdle waits until the hub handled everything queued before it, the hub goroutine
+// handles one event at a time.
+func waitIdle(t *testing.T, hub *Hub, probe *Client) {
+	t.Helper()
+
+	if err := hub.SendTo(probe, models.EventPong, nil); err != nil {
+		t.Fatalf("SendTo: %v", err)
+	}
+	expectEvent(t, probe, models.EventPong)
+}
+
+func TestHubRegisterBroadcastUnregister(t *testing.T) {
+	hub := newTestHub(t, HubConfig{})
+	alice := connect(t, hub, 1, "alice")
+	bob := connect(t, hub, 2, "bob")
+	expectPresence(t, alice, "bob", models.PresenceOnline)
+
+	if got := hub.Metrics(); got.ActiveConnections != 2 || got.AcceptedConnections != 2 {
+		t.Fatalf("got metrics %+v after registering two clients", got)
+	}
+
+	broadcastMessage(t, hub, "hello")
+	expectMessage(t, alice, "hello")
+	expectMessage(t, bob, "hello")
+
+	hub.Unregister(bob)
+	expectClosed(t, bob)
+	expectPresence(t, alice, "bob", models.PresenceOffline)
+	// Unregistering twice is allowed.
+	hub.Unregister(bob)
+
+	broadcastMessage(t, hub, "bye")
+	expectMessage(t, alice, "bye")
+	if got := hub.Metrics(); got.ActiveConnections != 1 || got.AcceptedConnections != 2 {
+		t.Fatalf("got metrics %+v after unregistering one client", got)
+	}
+}
+
+func TestHubBroadcastToAndExcept(t *testing.T) {
+	hub := newTestHub(t, HubConfig{})
+	alice := connect(t, hub, 1, "alice")
+	bob := connect(t, hub, 2, "bob")
+	carol := connect(t, hub, 3, "carol")
+
+	if err := hub.BroadcastTo([]string{"bob"}, models.EventMessageNew, models.MessagePayload{Message: "to bob"}); err != nil {
+		t.Fatalf("BroadcastTo: %v", err)
+	}
+	if err := hub.BroadcastExcept("bob", models.EventMessageNew, models.MessagePayload{Message: "not bob"}); err != nil {
+		t.Fatalf("BroadcastExcept: %v", err)
+	}
+
+	expectMessage(t, alice, "not bob")
+	expectMessage(t, bob, "to bob")
+	expectMessage(t, carol, "not bob")
+
+	waitIdle(t, hub, bob)
+	if len(bob.send) != 0 {
+		t.Fatalf("bob got %d unexpected events", len(bob.send))
+	}
+}
+
+// connectSlow registers a probe with a roomy queue and a slow client whose queue of a
+// single event is already full.
+func connectSlow(t *testing.T, hub *Hub) (probe *Client, slow *Client) {
+	t.Helper()
+
+	probe = NewClient(hub, nil, 1, "probe", 0, models.EnvelopeVersion)
+	probe.send = make(chan []byte, 64)
+	hub.Register(probe)
+	expectPresence(t, probe, "probe", models.PresenceOnline)
+
+	slow = connect(t, hub, 2, "slow")
+	expectPresence(t, probe, "slow", models.PresenceOnline)
+
+	broadcastMessage(t, hub, "first")
+	waitIdle(t, hub, probe)
+	if len(slow.send) != 1 {
+		t.Fatalf("slow client has %d queued events, want 1", len(slow.send))
+	}
+	return probe, slow
+}
+
+func TestHubSlowConsumerDrop(t *testing.T) {
+	hub := newTestHub(t, HubConfig{SlowConsumerPolicy: SlowConsumerDrop, SendBufferSize: 1})
+	probe, slow := connectSlow(t, hub)
+
+	broadcastMessage(t, hub, "second")
+	expectMessage(t, probe, "second")
+	waitIdle(t, hub, probe)
+
+	expectMessage(t, slow, "first")
+	if len(slow.send) != 0 {
+		t.Fatalf("slow client got %d events after its queue was full", len(slow.send))
+	}
+	if got := hub.Metrics().ActiveConnections; got != 2 {
+		t.Fatalf("got %d active connections, want the slow client to stay connected", got)
+	}
+
+	broadcastMessage(t, hub, "third")
+	expectMessage(t, slow, "third")
+}
+
+func TestHubSlowConsumerDisconnect(t *testing.T) {
+	hub := newTestHub(t, HubConfig{SlowConsumerPolicy: SlowConsumerDisconnect, SendBufferSize: 1})
+	probe, slow := connectSlow(t, hub)
+
+	broadcastMessage(t, hub, "second")
+	expectMessage(t, probe, "second")
+	expectPresence(t, probe, "slow", models.PresenceOffline)
+
+	expectMessage(t, slow, "first")
+	expectClosed(t, slow)
+	if got := hub.Metrics().ActiveConnections; got != 1 {
+		t.Fatalf("got %d active connections, want the slow client to be disconnected", got)
+	}
+}
+
+func TestHubSlowConsumerBlock(t *testing.T) {
+	hub := newTestHub(t, HubConfig{SlowConsumerPolicy: SlowConsumerBlock, SendBufferSize: 1})
+	probe, slow := connectSlow(t, hub)
+
+	broadcastMessage(t, hub, "second")
+	pong := make(chan error, 1)
+	go func() {
+		pong <- hub.SendTo(probe, models.EventPong, nil)
+	}()
+
+	// The hub waits for the slow client, so nothing queued after the second message is
+	// delivered until it reads.
+	select {
+	case err := <-pong:
+		t.Fatalf("SendTo returned %v while the hub was blocked", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expectMessage(t, slow, "first")
+	expectMessage(t, slow, "second")
+	if err := <-pong; err != nil {
+		t.Fatalf("SendTo: %v", err)
+	}
+	expectEvent(t, probe, models.EventPong)
+	if got := hub.Metrics().ActiveConnections; got != 2 {
+		t.Fatalf("got %d active connections, want the slow client to stay connected", got)
+	}
+}
+
+func TestSignalEventsHaveTheirOwnRateLimit(t *testing.T) {
+	hub := newTestHub(t, HubConfig{RateLimit: 1, RateBurst: 1, SignalRateLimit: 1, SignalRateBurst: 2})
+	client := NewClient(hub, nil, 1, "alice", 0, models.EnvelopeVersion)
+	noop := func(context.Context, *Client, models.Envelope) error { return nil }
+	chat, signal := rateLimited(noop), signalLimited(noop)
+
+	if err := chat(context.Background(), client, models.Envelope{}); err != nil {
+		t.Fatalf("first chat event: %v", err)
+	}
+	// Typing indicators and receipts are still allowed once the chat events are
+	// limited, and are limited on their own.
+	for i := 0; i < 2; i++ {
+		if err := signal(context.Background(), client, models.Envelope{}); err != nil {
+			t.Fatalf("signal event %d: %v", i, err)
+		}
+	}
+	var eventErr *EventError
+	if err := signal(context.Background(), client, models.Envelope{}); !errors.As(err, &eventErr) || eventErr.Code != models.ErrorCodeRateLimited {
+		t.Fatalf("got %v, want a rate_limited error", err)
+	}
+}
+
+func TestShutdownRefusesLateConnections(t *testing.T) {
+	hub, err := NewHub(HubConfig{Repositories: repository.NewMemoryRepositories()})
+	if err != nil {
+		t.Fatalf("NewHub: %v", err)
+	}
+	go hub.Run()
+	if !hub.trackConnection() {
+		t.Fatal("connection refused before Shutdown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- hub.Shutdown(ctx)
+	}()
+
+	// Shutdown waits for the running handler, but no longer lets new ones in.
+	deadline := time.Now().Add(testTimeout)
+	for hub.trackConnection() {
+		hub.connections.Done()
+		if time.Now().After(deadline) {
+			t.Fatal("connections still accepted after Shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the running handler", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	hub.connections.Done()
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Actor identifies the authenticated user on whose behalf a message action runs,
+// whether it comes from a WebSocket event or an HTTP request.
+type Actor struct {
+	UserID   uint
+	Username string
+}
+
+// GetAccessibleMessage loads the message with the given hex ID from the hub's
+// repositories. It returns an *EventError when the ID is invalid, or a not_found one
+// when the message does not exist or the actor cannot see it.
+func GetAccessibleMessage(ctx context.Context, hub *Hub, actor Actor, messageID string) (models.MessagePayload, error) {
+	id, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return models.MessagePayload{}, NewEventError(models.ErrorCodeBadRequest, "invalid message_id")
+	}
+
+	msg, err := hub.repos.Messages.GetMessageByID(ctx, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s not found", messageID)
+	}
+	if err != nil {
+		return msg, fmt.Errorf("failed to get message: %v", err)
+	}
+
+	canAccess, err := canAccessMessage(ctx, hub, actor, msg)
+	if err != nil {
+		return msg, fmt.Errorf("failed to check message access: %v", err)
+	}
+	if !canAccess {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s not found", messageID)
+	}
+	return msg, nil
+}
+
+// EditMessage replaces the text of a message, keeping the previous text and the editor
+// in its edit history, and broadcasts message.updated to the conversation. The author
+// and moderators can edit a message, see DeleteMessage.
+func EditMessage(ctx context.Context, hub *Hub, actor Actor, messageID string, text string) (models.MessagePayload, error) {
+	if strings.TrimSpace(text) == "" {
+		return models.MessagePayload{}, NewEventError(models.ErrorCodeBadRequest, "message cannot be empty")
+	}
+	if err := checkMessageLength(hub, text); err != nil {
+		return models.MessagePayload{}, err
+	}
+
+	msg, err := GetAccessibleMessage(ctx, hub, actor, messageID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s was deleted", messageID)
+	}
+	if msg.From != actor.Username {
+		isModerator, err := canModerate(ctx, hub, actor, msg)
+		if err != nil {
+			return msg, err
+		}
+		if !isModerator {
+			return msg, NewEventError(models.ErrorCodeForbidden, "only the author or a moderator can edit a message")
+		}
+	}
+	if msg.Message == text {
+		return msg, nil
+	}
+
+	updated, err := hub.repos.Messages.UpdateMessageText(ctx, msg.ID, msg.Message, text, actor.Username, time.Now())
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return msg, NewEventError(models.ErrorCodeConflict, "message %s was changed concurrently", messageID)
+	}
+	if err != nil {
+		return msg, fmt.Errorf("failed to update message: %v", err)
+	}
+
+	return updated, broadcastToConversation(ctx, hub, updated, models.EventMessageUpdated, updated)
+}
+
+// DeleteMessage turns a message into a tombstone and broadcasts message.deleted to the
+// conversation. The author and moderators can delete a message; moderators are users
+// with the moderator role and, for room messages, the owner of the room.
+func DeleteMessage(ctx context.Context, hub *Hub, actor Actor, messageID string) (models.MessagePayload, error) {
+	msg, err := GetAccessibleMessage(ctx, hub, actor, messageID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s was deleted", messageID)
+	}
+
+	if msg.From != actor.Username {
+		isModerator, err := canModerate(ctx, hub, actor, msg)
+		if err != nil {
+			return msg, err
+		}
+		if !isModerator {
+			return msg, NewEventError(models.ErrorCodeForbidden, "only the author or a moderator can delete a message")
+		}
+	}
+
+	deleted, err := hub.repos.Messages.SoftDeleteMessage(ctx, msg.ID, actor.Username, time.Now())
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s was deleted", messageID)
+	}
+	if err != nil {
+		return msg, fmt.Errorf("failed to delete message: %v", err)
+	}
+
+	return deleted, broadcastToConversation(ctx, hub, deleted, models.EventMessageDeleted, deleted)
+}
+
+// canAccessMessage reports whether the actor may see the message: everyone can see
+// the global channel, room members their room and the two participants their direct
+// conversation.
+func canAccessMessage(ctx context.Context, hub *Hub, actor Actor, msg models.MessagePayload) (bool, error) {
+	switch {
+	case msg.RoomID != 0:
+		return hub.repos.Rooms.IsRoomMember(ctx, msg.RoomID, actor.UserID)
+	case msg.ConversationID != "":
+		return msg.From == actor.Username || msg.To == actor.Username, nil
+	default:
+		return true, nil
+	}
+}
+
+// canModerate reports whether the actor may moderate the message, either by having the
+// moderator or admin role or by owning the room the message was posted in.
+func canModerate(ctx context.Context, hub *Hub, actor Actor, msg models.MessagePayload) (bool, error) {
+	user, err := hub.repos.Users.GetUserByUsername(ctx, actor.Username)
+	if err != nil {
+		return false, fmt.Errorf("failed to get user by username: %v", err)
+	}
+	if user.Role == models.RoleModerator || user.Role == models.RoleAdmin {
+		return true, nil
+	}
+
+	if msg.RoomID == 0 {
+		return false, nil
+	}
+	room, err := hub.repos.Rooms.GetRoomByID(ctx, msg.RoomID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get room: %v", err)
+	}
+	return room.OwnerID == actor.UserID, nil
+}
+
+// broadcastToConversation delivers an event about msg to everyone who can see the
+// conversation msg belongs to.
+func broadcastToConversation(ctx context.Context, hub *Hub, msg models.MessagePayload, eventType string, data interface{}) error {
+	switch {
+	case msg.RoomID != 0:
+		recipients, err := hub.repos.Rooms.GetRoomMemberUsernames(ctx, msg.RoomID)
+		if err != nil {
+			return fmt.Errorf("failed to get room members: %v", err)
+		}
+		return hub.BroadcastTo(recipients, eventType, data)
+	case msg.ConversationID != "":
+		recipients := []string{msg.From}
+		if msg.To != msg.From {
+			recipients = append(recipients, msg.To)
+		}
+		return hub.BroadcastTo(recipients, eventType, data)
+	default:
+		return hub.Broadcast(eventType, data)
+	}
+}
+
+// handleMessageEdit edits a message on behalf of the client's user, see EditMessage.
+func handleMessageEdit(ctx context.Context, client *Client, env models.Envelope) error {
+	var req models.MessageActionPayload
+	if err := json.Unmarshal(env.Data, &req); err != nil {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid message.edit event: %v", err)
+	}
+
+	msg, err := EditMessage(ctx, client.hub, client.Actor(), req.MessageID, req.Message)
+	if err != nil {
+		return err
+	}
+	client.Send(models.EventAck, models.AckPayload{Ref: env.ID, MessageID: msg.ID.Hex()})
+	return nil
+}
+
+// handleMessageDelete deletes a message, see DeleteMessage.
+func handleMessageDelete(ctx context.Context, client *Client, env models.Envelope) error {
+	var req models.MessageActionPayload
+	if err := json.Unmarshal(env.Data, &req); err != nil {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid message.delete event: %v", err)
+	}
+
+	msg, err := DeleteMessage(ctx, client.hub, client.Actor(), req.MessageID)
+	if err != nil {
+		return err
+	}
+	client.Send(models.EventAck, models.AckPayload{Ref: env.ID, MessageID: msg.ID.Hex()})
+	return nil
+}
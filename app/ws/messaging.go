@@ -1,67 +1,168 @@
 package ws
 
 import (
-	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/kooroshh/fiber-boostrap/app/models"
 	"github.com/kooroshh/fiber-boostrap/app/repository"
-	"github.com/kooroshh/fiber-boostrap/pkg/env"
-	"go.elastic.co/apm"
 )
 
-func ServeWSMessaging(app *fiber.App) {
-	// Membuat map untuk menyimpan koneksi client
-	var clients = make(map[*websocket.Conn]bool)
-	// Membuat channel untuk broadcast pesan
-	var broadcast = make(chan models.MessagePayload)
+// AuthSubprotocol is the WebSocket subprotocol a browser client uses to carry its
+// access token during the handshake, e.g. new WebSocket(url, ["access_token", token]).
+const AuthSubprotocol = "access_token"
 
-	app.Get("/message/v1/send", websocket.New(func(c *websocket.Conn) {
-		defer func() {
+// DefaultHub is the hub behind /message/v1/send. It is created by SetupHub.
+var DefaultHub *Hub
+
+// SetupHub creates DefaultHub from the environment variables with the given
+// repositories and starts it. It must be called after the env file is loaded and
+// before ServeWSMessaging. If the broker cannot be set up, it panics.
+func SetupHub(repos repository.Repositories) {
+	hub, err := NewHubFromEnv(repos)
+	if err != nil {
+		panic(err)
+	}
+	DefaultHub = hub
+	go DefaultHub.Run()
+}
+
+// ServeWSMessaging registers the WebSocket endpoint at /message/v1/send on app, it is
+// served by every listener of the app. The given middleware runs before the upgrade and
+// must authenticate the handshake by setting the "username" local; every message
+// read from the connection is stamped with that username instead of trusting the
+// "from" field sent by the client. Messages carrying a room_id are delivered to the
+// members of that room only, messages carrying a "to" username only to the two
+// participants of that direct conversation. Clients connecting with ?v=1 exchange
+// versioned models.Envelope events, older clients keep using bare message payloads.
+// Clients resuming after a disconnect pass ?since= with the ID of the last message
+// they saw (or its date in Unix milliseconds) to receive the messages they missed
+// before live delivery continues, see replay. The server pings every connection and
+// reaps those that stay silent for longer than the hub's pong timeout. Chat events are
+// rate limited per connection, typing indicators and receipts on a separate budget;
+// frames above the hub's size limit close the connection and repeated rate or length
+// violations close it with a policy violation.
+func ServeWSMessaging(app *fiber.App, middleware ...fiber.Handler) {
+	// Hub menyimpan koneksi client dan melakukan broadcast pesan
+	hub := DefaultHub
+
+	dispatcher := NewDispatcher()
+	dispatcher.Handle(models.EventMessageSend, rateLimited(handleMessageSend))
+	dispatcher.Handle(models.EventMessageEdit, rateLimited(handleMessageEdit))
+	dispatcher.Handle(models.EventMessageDelete, rateLimited(handleMessageDelete))
+	dispatcher.Handle(models.EventReactionAdd, rateLimited(handleReactionAdd))
+	dispatcher.Handle(models.EventReactionRemove, rateLimited(handleReactionRemove))
+	dispatcher.Handle(models.EventTypingStart, signalLimited(handleTypingStart))
+	dispatcher.Handle(models.EventTypingStop, signalLimited(handleTypingStop))
+	dispatcher.Handle(models.EventAck, signalLimited(handleAck))
+	dispatcher.Handle(models.EventRead, signalLimited(handleRead))
+	dispatcher.Handle(models.EventPing, handlePing)
+
+	handlers := append(middleware, websocket.New(func(c *websocket.Conn) {
+		// Koneksi yang masuk setelah Shutdown dimulai langsung ditutup
+		if !hub.trackConnection() {
+			_ = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
 			c.Close()
-			delete(clients, c)
+			return
+		}
+		defer hub.connections.Done()
+
+		username, ok := c.Locals("username").(string)
+		if !ok || username == "" {
+			log.Println("websocket connection without authenticated username")
+			c.Close()
+			return
+		}
+		userID, _ := c.Locals("user_id").(uint)
+		sessionID, _ := c.Locals("session_id").(uint)
+
+		version := 0
+		if v, err := strconv.Atoi(c.Query("v")); err == nil && v >= models.EnvelopeVersion {
+			version = models.EnvelopeVersion
+		}
+
+		since := c.Query("since")
+		client := NewClient(hub, c, userID, username, sessionID, version)
+		client.replaying = since != ""
+		hub.Register(client)
+
+		// Frame yang lebih besar dari batas langsung menutup koneksi
+		c.SetReadLimit(hub.maxFrameSize)
+
+		// Koneksi yang tidak membalas ping dalam batas waktu dianggap mati
+		_ = c.SetReadDeadline(time.Now().Add(hub.pongTimeout))
+		c.SetPongHandler(func(string) error {
+			return c.SetReadDeadline(time.Now().Add(hub.pongTimeout))
+		})
+
+		writerDone := make(chan struct{})
+		go func() {
+			client.writePump()
+			close(writerDone)
 		}()
 
-		clients[c] = true
+		// Pesan yang terlewat dikirim lewat hub sebelum event live yang ditahan selama replay
+		if client.replaying {
+			replay(client, since)
+		}
+
+		defer func() {
+			hub.typing.stopClient(client)
+			hub.Unregister(client)
+			<-writerDone
+		}()
 
 		for {
-			var msg models.MessagePayload
-			if err := c.ReadJSON(&msg); err != nil {
-				log.Println("error payload: ", err)
+			_, raw, err := c.ReadMessage()
+			if err != nil {
+				if isTimeout(err) {
+					client.reap("no pong received")
+				} else {
+					log.Println("error payload: ", err)
+				}
 				break
 			}
+			_ = c.SetReadDeadline(time.Now().Add(hub.pongTimeout))
 
-			tx := apm.DefaultTracer.StartTransaction("Send Message", "ws")
-			ctx := apm.ContextWithTransaction(context.Background(), tx)
-
-			msg.Date = time.Now()
-			err := repository.InsertNewMessage(ctx, msg)
+			env, err := decodeEnvelope(client, raw)
 			if err != nil {
-				log.Println(err)
+				client.SendError("", NewEventError(models.ErrorCodeBadRequest, "malformed event: %v", err))
+				continue
 			}
-			tx.End()
+			dispatcher.Dispatch(client, env)
 
-			broadcast <- msg
-		}
-	}))
-
-	go func() {
-		for {
-			msg := <-broadcast
-			for client := range clients {
-				err := client.WriteJSON(msg)
-				if err != nil {
-					log.Println("Failed to write json: ", err)
-					client.Close()
-					delete(clients, client)
-				}
+			// Client yang terus melanggar batas diputus dengan close frame policy violation
+			if client.violations >= hub.maxViolations {
+				log.Printf("closing connection of %s after %d violations", username, client.violations)
+				client.closeCode.Store(websocket.ClosePolicyViolation)
+				break
 			}
 		}
-	}()
+	}, websocket.Config{Subprotocols: []string{AuthSubprotocol}}))
+	app.Get("/message/v1/send", handlers...)
+}
+
+// decodeEnvelope decodes a frame received from the client. Clients without envelope
+// support can only send bare message payloads, which are wrapped as message.send.
+func decodeEnvelope(client *Client, raw []byte) (models.Envelope, error) {
+	if client.Version < models.EnvelopeVersion {
+		return models.Envelope{Version: client.Version, Type: models.EventMessageSend, Data: raw}, nil
+	}
 
-	log.Fatal(app.Listen(fmt.Sprintf("%s:%s", env.GetEnv("APP_HOST", "localhost"), env.GetEnv("APP_PORT_SOCKET", "8080"))))
+	var env models.Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return env, err
+	}
+	if env.Version != models.EnvelopeVersion {
+		return env, fmt.Errorf("unsupported envelope version %d", env.Version)
+	}
+	if env.Type == "" {
+		return env, fmt.Errorf("missing event type")
+	}
+	return env, nil
 }
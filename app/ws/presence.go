@@ -0,0 +1,207 @@
+package ws
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// PresenceStore tracks which instances hold connections of each user, so that a user
+// connected to any instance sharing the broker counts as online on all of them.
+// Instances only report the first and last local connection of a user.
+type PresenceStore interface {
+	// Connect records that instance got a connection of username and reports whether
+	// the user had no connection on any instance before.
+	Connect(ctx context.Context, instance string, username string) (bool, error)
+	// Disconnect records that instance lost the last connection of username and
+	// reports whether the user has no connection left on any instance.
+	Disconnect(ctx context.Context, instance string, username string) (bool, error)
+	// Online returns which of the given users have a connection on any instance.
+	Online(ctx context.Context, usernames []string) (map[string]bool, error)
+	// Refresh confirms that instance still holds connections of usernames. Stores
+	// shared between processes forget the connections of instances that stop
+	// refreshing, e.g. because they crashed.
+	Refresh(ctx context.Context, instance string, usernames []string) error
+	Close() error
+}
+
+// InProcessPresenceStore is a PresenceStore for the hubs of a single process. It is
+// the default next to the InProcessBroker.
+type InProcessPresenceStore struct {
+	mu    sync.Mutex
+	users map[string]map[string]bool
+}
+
+// NewInProcessPresenceStore creates a store in which every user is offline.
+func NewInProcessPresenceStore() *InProcessPresenceStore {
+	return &InProcessPresenceStore{users: make(map[string]map[string]bool)}
+}
+
+func (s *InProcessPresenceStore) Connect(ctx context.Context, instance string, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[username] == nil {
+		s.users[username] = make(map[string]bool)
+	}
+	s.users[username][instance] = true
+	return len(s.users[username]) == 1, nil
+}
+
+func (s *InProcessPresenceStore) Disconnect(ctx context.Context, instance string, username string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users[username], instance)
+	if len(s.users[username]) > 0 {
+		return false, nil
+	}
+	delete(s.users, username)
+	return true, nil
+}
+
+func (s *InProcessPresenceStore) Online(ctx context.Context, usernames []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	online := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		online[username] = len(s.users[username]) > 0
+	}
+	return online, nil
+}
+
+func (s *InProcessPresenceStore) Refresh(ctx context.Context, instance string, usernames []string) error {
+	return nil
+}
+
+func (s *InProcessPresenceStore) Close() error {
+	return nil
+}
+
+// presenceChange records that the user of client got its first connection to this
+// instance or lost its last one.
+type presenceChange struct {
+	client *Client
+	online bool
+	at     time.Time
+}
+
+// Online returns which of the given users have a live connection to any instance.
+func (h *Hub) Online(ctx context.Context, usernames []string) (map[string]bool, error) {
+	return h.presence.Online(ctx, usernames)
+}
+
+// flushPresence hands the collected presence changes to presenceLoop. It runs on the
+// hub goroutine, which must not wait for the presence store.
+func (h *Hub) flushPresence() {
+	if len(h.presenceChanges) == 0 {
+		return
+	}
+
+	h.pending.Add(len(h.presenceChanges))
+	h.presenceMu.Lock()
+	h.presenceQueue = append(h.presenceQueue, h.presenceChanges...)
+	h.presenceMu.Unlock()
+	h.presenceChanges = nil
+
+	select {
+	case h.presenceSignal <- struct{}{}:
+	default:
+	}
+}
+
+// presenceLoop records the queued presence changes in the presence store one at a time,
+// in the order they happened. A user is only announced online or offline, and its last
+// seen time stored, when the change is global, i.e. no other instance holds a
+// connection of the user.
+func (h *Hub) presenceLoop() {
+	for range h.presenceSignal {
+		for {
+			h.presenceMu.Lock()
+			changes := h.presenceQueue
+			h.presenceQueue = nil
+			h.presenceMu.Unlock()
+			if len(changes) == 0 {
+				break
+			}
+
+			for _, change := range changes {
+				h.announcePresence(change)
+				h.pending.Done()
+			}
+		}
+	}
+}
+
+func (h *Hub) announcePresence(change presenceChange) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.writeTimeout)
+	defer cancel()
+
+	username := change.client.Username
+	payload := models.PresencePayload{Username: username, Status: models.PresenceOnline}
+	if change.online {
+		first, err := h.presence.Connect(ctx, h.instanceID, username)
+		if err != nil {
+			log.Printf("failed to record connection of %s: %v", username, err)
+			first = true
+		}
+		if !first {
+			return
+		}
+	} else {
+		last, err := h.presence.Disconnect(ctx, h.instanceID, username)
+		if err != nil {
+			log.Printf("failed to record disconnection of %s: %v", username, err)
+			last = true
+		}
+		if !last {
+			return
+		}
+		at := change.at
+		payload.Status = models.PresenceOffline
+		payload.LastSeenAt = &at
+		h.storeLastSeen(change.client.UserID, at)
+	}
+
+	if err := h.Broadcast(models.EventPresence, payload); err != nil {
+		log.Println("failed to encode presence: ", err)
+	}
+}
+
+// refreshPresence periodically confirms the users connected to this instance in the
+// presence store until the hub is shut down.
+func (h *Hub) refreshPresence() {
+	ticker := time.NewTicker(h.presenceTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.closed:
+			return
+		}
+
+		h.usersMu.RLock()
+		usernames := make([]string, 0, len(h.users))
+		for username := range h.users {
+			usernames = append(usernames, username)
+		}
+		h.usersMu.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.writeTimeout)
+		if err := h.presence.Refresh(ctx, h.instanceID, usernames); err != nil {
+			log.Println("failed to refresh presence: ", err)
+		}
+		cancel()
+	}
+}
+
+func (h *Hub) storeLastSeen(userID uint, at time.Time) {
+	if err := h.repos.Users.UpdateUserLastSeen(context.Background(), userID, at); err != nil {
+		log.Printf("failed to store last seen of user %d: %v", userID, err)
+	}
+}
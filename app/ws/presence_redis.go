@@ -0,0 +1,137 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// liveInstancesScript counts, for every user key in KEYS, the instances holding a
+// connection of the user whose heartbeat key (ARGV[1] followed by the instance ID) has
+// not expired. Instances without heartbeat are removed from the set on the way.
+const liveInstancesScript = `
+local counts = {}
+for i, key in ipairs(KEYS) do
+	local live = 0
+	for _, instance in ipairs(redis.call('SMEMBERS', key)) do
+		if redis.call('EXISTS', ARGV[1] .. instance) == 1 then
+			live = live + 1
+		else
+			redis.call('SREM', key, instance)
+		end
+	end
+	counts[i] = live
+end
+return counts
+`
+
+// connectScript adds the instance ARGV[2] to the user key KEYS[1], renews the instance's
+// heartbeat and returns the number of live instances of the user, see
+// liveInstancesScript. ARGV[3] is the TTL in milliseconds.
+var connectScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+redis.call('SET', ARGV[1] .. ARGV[2], 1, 'PX', ARGV[3])
+` + liveInstancesScript)
+
+// disconnectScript removes the instance ARGV[2] from the user key KEYS[1] and returns
+// the number of live instances of the user left.
+var disconnectScript = redis.NewScript(`
+redis.call('SREM', KEYS[1], ARGV[2])
+` + liveInstancesScript)
+
+var onlineScript = redis.NewScript(liveInstancesScript)
+
+// RedisPresenceStore is a PresenceStore shared by the instances connected to a Redis
+// server. Every user has a set of the instances holding connections of the user, and
+// every instance a heartbeat key that expires after ttl unless the instance refreshes
+// it. Instances whose heartbeat expired no longer count, so the users of a crashed
+// instance go offline after ttl, although no presence event announces it.
+type RedisPresenceStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedisPresenceStore connects to the Redis server at url and creates a store whose
+// keys start with prefix. It fails when the server cannot be reached.
+func NewRedisPresenceStore(url string, prefix string, ttl time.Duration) (*RedisPresenceStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+
+	client := redis.NewClient(opts)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	return &RedisPresenceStore{client: client, prefix: prefix, ttl: ttl}, nil
+}
+
+func (s *RedisPresenceStore) userKey(username string) string {
+	return s.prefix + ":presence:" + username
+}
+
+// instanceKeyPrefix is followed by the instance ID in the heartbeat keys.
+func (s *RedisPresenceStore) instanceKeyPrefix() string {
+	return s.prefix + ":instance:"
+}
+
+func (s *RedisPresenceStore) Connect(ctx context.Context, instance string, username string) (bool, error) {
+	counts, err := connectScript.Run(ctx, s.client, []string{s.userKey(username)}, s.instanceKeyPrefix(), instance, s.ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return false, fmt.Errorf("failed to record connection: %v", err)
+	}
+	return counts[0] == 1, nil
+}
+
+func (s *RedisPresenceStore) Disconnect(ctx context.Context, instance string, username string) (bool, error) {
+	counts, err := disconnectScript.Run(ctx, s.client, []string{s.userKey(username)}, s.instanceKeyPrefix(), instance).Int64Slice()
+	if err != nil {
+		return false, fmt.Errorf("failed to record disconnection: %v", err)
+	}
+	return counts[0] == 0, nil
+}
+
+func (s *RedisPresenceStore) Online(ctx context.Context, usernames []string) (map[string]bool, error) {
+	online := make(map[string]bool, len(usernames))
+	if len(usernames) == 0 {
+		return online, nil
+	}
+
+	keys := make([]string, len(usernames))
+	for i, username := range usernames {
+		keys[i] = s.userKey(username)
+	}
+	counts, err := onlineScript.Run(ctx, s.client, keys, s.instanceKeyPrefix()).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get presence: %v", err)
+	}
+	for i, username := range usernames {
+		online[username] = counts[i] > 0
+	}
+	return online, nil
+}
+
+// Refresh renews the heartbeat of instance and the expiry of the users' keys. It does
+// not add the instance to the users' sets, so that it cannot race with Disconnect.
+func (s *RedisPresenceStore) Refresh(ctx context.Context, instance string, usernames []string) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.instanceKeyPrefix()+instance, 1, s.ttl)
+		for _, username := range usernames {
+			pipe.PExpire(ctx, s.userKey(username), s.ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to refresh presence: %v", err)
+	}
+	return nil
+}
+
+func (s *RedisPresenceStore) Close() error {
+	return s.client.Close()
+}
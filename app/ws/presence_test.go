@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+const testPresenceTTL = 30 * time.Second
+
+func newTestRedisPresenceStore(t *testing.T) (*RedisPresenceStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	store, err := NewRedisPresenceStore("redis://"+server.Addr(), "test", testPresenceTTL)
+	if err != nil {
+		t.Fatalf("NewRedisPresenceStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, server
+}
+
+func expectOnline(t *testing.T, store PresenceStore, username string, want bool) {
+	t.Helper()
+
+	online, err := store.Online(context.Background(), []string{username})
+	if err != nil {
+		t.Fatalf("Online: %v", err)
+	}
+	if online[username] != want {
+		t.Fatalf("%s online = %v, want %v", username, online[username], want)
+	}
+}
+
+func testPresenceStore(t *testing.T, store PresenceStore) {
+	ctx := context.Background()
+
+	expectOnline(t, store, "alice", false)
+	if first, err := store.Connect(ctx, "a", "alice"); err != nil || !first {
+		t.Fatalf("first Connect = %v, %v, want true", first, err)
+	}
+	if first, err := store.Connect(ctx, "b", "alice"); err != nil || first {
+		t.Fatalf("Connect on a second instance = %v, %v, want false", first, err)
+	}
+	expectOnline(t, store, "alice", true)
+	expectOnline(t, store, "bob", false)
+
+	if last, err := store.Disconnect(ctx, "a", "alice"); err != nil || last {
+		t.Fatalf("Disconnect while connected elsewhere = %v, %v, want false", last, err)
+	}
+	expectOnline(t, store, "alice", true)
+	if last, err := store.Disconnect(ctx, "b", "alice"); err != nil || !last {
+		t.Fatalf("last Disconnect = %v, %v, want true", last, err)
+	}
+	expectOnline(t, store, "alice", false)
+}
+
+func TestInProcessPresenceStore(t *testing.T) {
+	testPresenceStore(t, NewInProcessPresenceStore())
+}
+
+func TestRedisPresenceStore(t *testing.T) {
+	store, _ := newTestRedisPresenceStore(t)
+	testPresenceStore(t, store)
+}
+
+func TestRedisPresenceStoreExpiresCrashedInstances(t *testing.T) {
+	store, server := newTestRedisPresenceStore(t)
+	ctx := context.Background()
+
+	if _, err := store.Connect(ctx, "a", "alice"); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := store.Connect(ctx, "b", "bob"); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	// Instance a keeps refreshing, instance b crashed.
+	for i := 0; i < 3; i++ {
+		server.FastForward(testPresenceTTL / 2)
+		if err := store.Refresh(ctx, "a", []string{"alice"}); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+	}
+	expectOnline(t, store, "alice", true)
+	expectOnline(t, store, "bob", false)
+
+	if first, err := store.Connect(ctx, "c", "bob"); err != nil || !first {
+		t.Fatalf("Connect after the crash = %v, %v, want true", first, err)
+	}
+}
+
+// waitInstances waits until the store knows count instances holding connections of
+// username.
+func waitInstances(t *testing.T, store *InProcessPresenceStore, username string, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		store.mu.Lock()
+		got := len(store.users[username])
+		store.mu.Unlock()
+		if got == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is connected to %d instances, want %d", username, got, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHubPresenceAcrossInstances(t *testing.T) {
+	broker := NewInProcessBroker()
+	presence := NewInProcessPresenceStore()
+	first := newTestHub(t, HubConfig{Broker: broker, Presence: presence})
+	second := newTestHub(t, HubConfig{Broker: broker, Presence: presence})
+
+	bob := connect(t, first, 2, "bob")
+	alice := connect(t, first, 1, "alice")
+	expectPresence(t, bob, "alice", models.PresenceOnline)
+
+	// A second connection to another instance is no presence change.
+	aliceElsewhere := NewClient(second, nil, 1, "alice", 0, models.EnvelopeVersion)
+	second.Register(aliceElsewhere)
+	waitInstances(t, presence, "alice", 2)
+	first.Unregister(alice)
+	expectClosed(t, alice)
+	waitInstances(t, presence, "alice", 1)
+
+	online, err := first.Online(context.Background(), []string{"alice"})
+	if err != nil || !online["alice"] {
+		t.Fatalf("Online = %v, %v, want alice online on the other instance", online, err)
+	}
+
+	second.Unregister(aliceElsewhere)
+	expectClosed(t, aliceElsewhere)
+	// The first presence event bob gets about alice is the one of her last connection.
+	expectPresence(t, bob, "alice", models.PresenceOffline)
+	if len(bob.send) != 0 {
+		t.Fatalf("bob got %d unexpected events", len(bob.send))
+	}
+}
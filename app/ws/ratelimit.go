@@ -0,0 +1,74 @@
+package ws
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// tokenBucket allows rate events per second on average and up to burst at once. It
+// is only used by the read loop of its connection and needs no locking.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, burst int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow takes a token from the bucket and reports whether there was one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimited wraps the handler of a chat event so that each connection can only send
+// as many of those events as its token bucket allows. Events over the limit are
+// rejected with a rate_limited error.
+func rateLimited(handler HandlerFunc) HandlerFunc {
+	return limitedBy(func(client *Client) *tokenBucket { return client.limiter }, handler)
+}
+
+// signalLimited is rateLimited for typing indicators and receipts, which take tokens
+// from their own, larger bucket so that they cannot starve chat events.
+func signalLimited(handler HandlerFunc) HandlerFunc {
+	return limitedBy(func(client *Client) *tokenBucket { return client.signalLimiter }, handler)
+}
+
+func limitedBy(bucket func(*Client) *tokenBucket, handler HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, client *Client, env models.Envelope) error {
+		if !bucket(client).allow(time.Now()) {
+			return NewEventError(models.ErrorCodeRateLimited, "too many events, slow down")
+		}
+		return handler(ctx, client, env)
+	}
+}
+
+// checkMessageLength rejects message texts longer than the hub allows with a
+// message_too_long error.
+func checkMessageLength(hub *Hub, text string) error {
+	if utf8.RuneCountInString(text) > hub.maxMessageLen {
+		return NewEventError(models.ErrorCodeMessageTooLong, "message is longer than %d characters", hub.maxMessageLen)
+	}
+	return nil
+}
+
+// isViolation reports whether an error event counts towards the violations after
+// which a connection is closed.
+func isViolation(err *EventError) bool {
+	return err.Code == models.ErrorCodeRateLimited || err.Code == models.ErrorCodeMessageTooLong
+}
@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+const maxEmojiLength = 32
+
+// AddReaction adds the actor's reaction with emoji to a message the actor can see and
+// broadcasts reaction.updated to the conversation. Reacting twice with the same emoji
+// is a no-op.
+func AddReaction(ctx context.Context, hub *Hub, actor Actor, messageID string, emoji string) (models.MessagePayload, error) {
+	return changeReaction(ctx, hub, actor, messageID, emoji, models.ReactionAdded)
+}
+
+// RemoveReaction removes the actor's reaction with emoji from a message and broadcasts
+// reaction.updated to the conversation. Removing a missing reaction is a no-op.
+func RemoveReaction(ctx context.Context, hub *Hub, actor Actor, messageID string, emoji string) (models.MessagePayload, error) {
+	return changeReaction(ctx, hub, actor, messageID, emoji, models.ReactionRemoved)
+}
+
+func changeReaction(ctx context.Context, hub *Hub, actor Actor, messageID string, emoji string, action string) (models.MessagePayload, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return models.MessagePayload{}, err
+	}
+
+	msg, err := GetAccessibleMessage(ctx, hub, actor, messageID)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted && action == models.ReactionAdded {
+		return msg, NewEventError(models.ErrorCodeNotFound, "message %s was deleted", messageID)
+	}
+
+	var changed bool
+	if action == models.ReactionAdded {
+		msg, changed, err = hub.repos.Messages.AddReaction(ctx, msg.ID, emoji, actor.Username)
+	} else {
+		msg, changed, err = hub.repos.Messages.RemoveReaction(ctx, msg.ID, emoji, actor.Username)
+	}
+	if err != nil {
+		return msg, fmt.Errorf("failed to update reaction: %v", err)
+	}
+	if !changed {
+		return msg, nil
+	}
+
+	return msg, broadcastToConversation(ctx, hub, msg, models.EventReactionUpdated, models.ReactionPayload{
+		MessageID: msg.ID.Hex(),
+		Emoji:     emoji,
+		Username:  actor.Username,
+		Action:    action,
+		Count:     msg.Reactions[emoji].Count,
+	})
+}
+
+// validateEmoji accepts short strings without whitespace. The emoji becomes part of a
+// document field path, so dots and a leading dollar sign are rejected as well.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) ||
+		strings.HasPrefix(emoji, "$") || strings.ContainsRune(emoji, '.') ||
+		strings.IndexFunc(emoji, unicode.IsSpace) >= 0 {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid emoji")
+	}
+	return nil
+}
+
+// handleReactionAdd adds a reaction of the client's user, see AddReaction.
+func handleReactionAdd(ctx context.Context, client *Client, env models.Envelope) error {
+	return handleReaction(ctx, client, env, models.ReactionAdded)
+}
+
+// handleReactionRemove removes a reaction of the client's user, see RemoveReaction.
+func handleReactionRemove(ctx context.Context, client *Client, env models.Envelope) error {
+	return handleReaction(ctx, client, env, models.ReactionRemoved)
+}
+
+func handleReaction(ctx context.Context, client *Client, env models.Envelope, action string) error {
+	var req models.ReactionPayload
+	if err := json.Unmarshal(env.Data, &req); err != nil {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid %s event: %v", env.Type, err)
+	}
+
+	msg, err := changeReaction(ctx, client.hub, client.Actor(), req.MessageID, req.Emoji, action)
+	if err != nil {
+		return err
+	}
+	client.Send(models.EventAck, models.AckPayload{Ref: env.ID, MessageID: msg.ID.Hex()})
+	return nil
+}
@@ -0,0 +1,68 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+// handleAck marks the message named by message_id as delivered to the client's user
+// and tells the sender with a receipt event.
+func handleAck(ctx context.Context, client *Client, env models.Envelope) error {
+	return handleReceipt(ctx, client, env, models.ReceiptDelivered)
+}
+
+// handleRead marks the message named by message_id as read by the client's user, moves
+// the user's read marker of the conversation forward and tells the sender with a
+// receipt event.
+func handleRead(ctx context.Context, client *Client, env models.Envelope) error {
+	return handleReceipt(ctx, client, env, models.ReceiptRead)
+}
+
+func handleReceipt(ctx context.Context, client *Client, env models.Envelope, status string) error {
+	var req models.AckPayload
+	if err := json.Unmarshal(env.Data, &req); err != nil {
+		return NewEventError(models.ErrorCodeBadRequest, "invalid %s event: %v", env.Type, err)
+	}
+
+	msg, err := GetAccessibleMessage(ctx, client.hub, client.Actor(), req.MessageID)
+	if err != nil {
+		return err
+	}
+	// Senders do not produce receipts for their own messages.
+	if msg.From == client.Username {
+		return nil
+	}
+
+	now := time.Now()
+	changed, err := client.hub.repos.Messages.UpdateMessageReceipt(ctx, msg.ID, client.Username, status, now)
+	if err != nil {
+		return err
+	}
+
+	if status == models.ReceiptRead {
+		_, err = client.hub.repos.Messages.UpsertReadMarker(ctx, models.ReadMarker{
+			Username:     client.Username,
+			Conversation: msg.ConversationKey(),
+			MessageID:    msg.ID,
+			MessageDate:  msg.Date,
+			UpdatedAt:    now,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update read marker: %v", err)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return client.hub.BroadcastTo([]string{msg.From}, models.EventReceipt, models.ReceiptPayload{
+		MessageID: msg.ID.Hex(),
+		Username:  client.Username,
+		Status:    status,
+		At:        now,
+	})
+}
@@ -0,0 +1,172 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"go.elastic.co/apm"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// replayBatch is the outcome of a replay handed to the hub: the events to deliver
+// before the live ones, or a gap when more messages were missed than are replayed.
+type replayBatch struct {
+	since  string
+	events []outbound
+	gap    bool
+}
+
+// replay loads the messages the client missed since its last seen message and hands
+// them to the hub, which delivers them as message.new events in the order they were
+// sent. since is the ID of the last message the client saw or a date in Unix
+// milliseconds. The client must have been registered with replaying set, so that
+// nothing sent in the meantime is lost: the hub holds the live events of the client
+// back until the replay is delivered. Messages sent during the replay can therefore
+// arrive twice; clients deduplicate them by ID. When more than the hub's replay limit
+// was missed, or more live events arrived than the hub holds back, the client gets a
+// gap instead, see Hub.replayGap, and has to refetch the history.
+func replay(client *Client, since string) {
+	tx := apm.DefaultTracer.StartTransaction("replay", "ws")
+	defer tx.End()
+	ctx := apm.ContextWithTransaction(context.Background(), tx)
+
+	batch := &replayBatch{since: since}
+	batch.events, batch.gap = loadReplay(ctx, client, since)
+	client.hub.broadcast <- outbound{client: client, replay: batch}
+}
+
+// loadReplay returns the events replaying the messages missed since, an error event
+// when they cannot be loaded, or reports a gap.
+func loadReplay(ctx context.Context, client *Client, since string) ([]outbound, bool) {
+	cursor, err := parseReplaySince(ctx, client.hub, since)
+	if err != nil {
+		return errorEvents(models.ErrorCodeBadRequest, err.Error()), false
+	}
+
+	roomIDs, err := client.hub.repos.Rooms.GetRoomIDsOfMember(ctx, client.UserID)
+	if err != nil {
+		log.Println(fmt.Errorf("failed to get rooms of member: %v", err))
+		return errorEvents(models.ErrorCodeInternal, "internal server error"), false
+	}
+
+	// Satu pesan ekstra diambil untuk mengetahui apakah jumlah pesan melebihi batas
+	limit := int64(client.hub.replayLimit)
+	messages, err := client.hub.repos.Messages.GetMessagesSince(ctx, client.Username, roomIDs, cursor, limit+1)
+	if err != nil {
+		log.Println(err)
+		return errorEvents(models.ErrorCodeInternal, "internal server error"), false
+	}
+	if int64(len(messages)) > limit {
+		return nil, true
+	}
+
+	events := make([]outbound, 0, len(messages))
+	for _, msg := range messages {
+		out, err := encodeEvent(models.EventMessageNew, msg)
+		if err != nil {
+			log.Println("failed to encode message: ", err)
+			continue
+		}
+		events = append(events, out)
+	}
+	return events, false
+}
+
+func errorEvents(code string, message string) []outbound {
+	out, err := encodeEvent(models.EventError, models.ErrorPayload{Code: code, Message: message})
+	if err != nil {
+		log.Println("failed to encode error: ", err)
+		return nil
+	}
+	return []outbound{out}
+}
+
+// parseReplaySince resolves the since parameter of the handshake to the position of the
+// last message the client saw. A date only covers the messages sent after it.
+func parseReplaySince(ctx context.Context, hub *Hub, since string) (models.HistoryCursor, error) {
+	if id, err := primitive.ObjectIDFromHex(since); err == nil {
+		msg, err := hub.repos.Messages.GetMessageByID(ctx, id)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.HistoryCursor{}, fmt.Errorf("unknown since message")
+		}
+		if err != nil {
+			log.Println(fmt.Errorf("failed to get since message: %v", err))
+			return models.HistoryCursor{}, fmt.Errorf("failed to resolve since")
+		}
+		return models.HistoryCursor{Date: msg.Date, ID: msg.ID}, nil
+	}
+
+	millis, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || millis < 0 {
+		return models.HistoryCursor{}, fmt.Errorf("invalid since")
+	}
+	return models.HistoryCursor{Date: time.UnixMilli(millis)}, nil
+}
+
+// holdBack keeps a live frame for a client whose replay is not delivered yet. Once
+// more frames are waiting than fit next to the replay in the send queue, they are
+// dropped and the client gets a gap. It runs on the hub goroutine.
+func (h *Hub) holdBack(client *Client, frame []byte) {
+	if client.heldOverflow {
+		return
+	}
+	if len(client.held) >= h.sendBufferSize-h.replayLimit {
+		log.Printf("too many live events for %s during its replay, sending a gap", client.Username)
+		client.held, client.heldOverflow = nil, true
+		return
+	}
+	client.held = append(client.held, frame)
+}
+
+// finishReplay delivers the replay of a client followed by the live events held back
+// in the meantime. The replay limit leaves room for both in the send queue, which is
+// empty until then. It runs on the hub goroutine.
+func (h *Hub) finishReplay(client *Client, batch *replayBatch) {
+	if !h.clients[client] || !client.replaying {
+		return
+	}
+	held, overflow := client.held, client.heldOverflow
+	client.replaying, client.held, client.heldOverflow = false, nil, false
+
+	if batch.gap || overflow {
+		if !h.replayGap(client, batch.since) {
+			return
+		}
+	} else {
+		for _, event := range batch.events {
+			h.deliver(client, event)
+		}
+	}
+	if !overflow {
+		for _, frame := range held {
+			h.enqueue(client, frame)
+		}
+	}
+}
+
+// replayGap tells the client that it missed too much to be replayed. Clients with
+// envelope support get a replay.gap event, the others are closed with CloseReplayGap
+// since a bare message payload cannot express the gap. It reports whether the client
+// is still connected.
+func (h *Hub) replayGap(client *Client, since string) bool {
+	if client.Version < models.EnvelopeVersion {
+		log.Printf("closing connection of %s, too many missed messages to replay", client.Username)
+		client.closeCode.Store(CloseReplayGap)
+		h.remove(client)
+		return false
+	}
+
+	out, err := encodeEvent(models.EventReplayGap, models.ReplayGapPayload{Since: since, Limit: int64(h.replayLimit)})
+	if err != nil {
+		log.Println("failed to encode replay gap: ", err)
+		return true
+	}
+	h.deliver(client, out)
+	return true
+}
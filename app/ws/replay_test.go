@@ -0,0 +1,138 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
+)
+
+// insertMessages stores count global messages one millisecond apart and returns them.
+func insertMessages(t *testing.T, repos repository.Repositories, count int) []models.MessagePayload {
+	t.Helper()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	messages := make([]models.MessagePayload, 0, count)
+	for i := 0; i < count; i++ {
+		msg, _, err := repos.Messages.InsertNewMessage(context.Background(), models.MessagePayload{
+			Type:    models.MessageTypeText,
+			From:    "alice",
+			Message: fmt.Sprintf("missed %d", i),
+			Date:    start.Add(time.Duration(i) * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatalf("InsertNewMessage: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// resume registers a client of bob resuming with since, without replaying yet.
+func resume(hub *Hub, version int) *Client {
+	client := NewClient(hub, nil, 2, "bob", 0, version)
+	client.replaying = true
+	hub.Register(client)
+	return client
+}
+
+func TestReplayDeliversMissedMessagesBeforeLiveEvents(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	hub := newTestHub(t, HubConfig{Repositories: repos})
+	missed := insertMessages(t, repos, 3)
+
+	bob := resume(hub, models.EnvelopeVersion)
+	// Live events arriving before the replay is loaded wait for it.
+	broadcastMessage(t, hub, "live")
+	replay(bob, missed[0].ID.Hex())
+
+	expectMessage(t, bob, "missed 1")
+	expectMessage(t, bob, "missed 2")
+	expectMessage(t, bob, "live")
+}
+
+func TestReplayDeliversMessagesOfTheSameMillisecond(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	hub := newTestHub(t, HubConfig{Repositories: repos})
+	date := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	var missed []models.MessagePayload
+	for _, text := range []string{"first", "second"} {
+		msg, _, err := repos.Messages.InsertNewMessage(context.Background(), models.MessagePayload{
+			Type:    models.MessageTypeText,
+			From:    "alice",
+			Message: text,
+			Date:    date,
+		})
+		if err != nil {
+			t.Fatalf("InsertNewMessage: %v", err)
+		}
+		missed = append(missed, msg)
+	}
+
+	bob := resume(hub, models.EnvelopeVersion)
+	replay(bob, missed[0].ID.Hex())
+	broadcastMessage(t, hub, "live")
+
+	expectMessage(t, bob, "second")
+	expectMessage(t, bob, "live")
+}
+
+func TestReplayGap(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	hub := newTestHub(t, HubConfig{Repositories: repos, ReplayLimit: 2})
+	missed := insertMessages(t, repos, 4)
+
+	bob := resume(hub, models.EnvelopeVersion)
+	broadcastMessage(t, hub, "live")
+	replay(bob, missed[0].ID.Hex())
+
+	var gap models.ReplayGapPayload
+	env := expectEvent(t, bob, models.EventReplayGap)
+	if err := json.Unmarshal(env.Data, &gap); err != nil {
+		t.Fatalf("failed to decode replay gap: %v", err)
+	}
+	if gap.Since != missed[0].ID.Hex() || gap.Limit != 2 {
+		t.Fatalf("got replay gap %+v", gap)
+	}
+	// Live events held back are delivered after the gap.
+	expectMessage(t, bob, "live")
+}
+
+func TestReplayGapClosesLegacyClients(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	hub := newTestHub(t, HubConfig{Repositories: repos, ReplayLimit: 2})
+	missed := insertMessages(t, repos, 4)
+
+	bob := resume(hub, 0)
+	replay(bob, missed[0].ID.Hex())
+
+	expectClosed(t, bob)
+	if code := bob.closeCode.Load(); code != CloseReplayGap {
+		t.Fatalf("got close code %d, want %d", code, CloseReplayGap)
+	}
+}
+
+func TestReplayGapWhenTooManyLiveEventsArrive(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	hub := newTestHub(t, HubConfig{Repositories: repos, SendBufferSize: 4, ReplayLimit: 2})
+	missed := insertMessages(t, repos, 2)
+
+	bob := resume(hub, models.EnvelopeVersion)
+	for i := 0; i < 4; i++ {
+		broadcastMessage(t, hub, "live")
+	}
+	replay(bob, missed[0].ID.Hex())
+
+	expectEvent(t, bob, models.EventReplayGap)
+	probe := connect(t, hub, 3, "probe")
+	waitIdle(t, hub, probe)
+	for len(bob.send) > 0 {
+		if env := nextEvent(t, bob); env.Type == models.EventMessageNew {
+			t.Fatalf("got a message held back after the replay gap")
+		}
+	}
+}
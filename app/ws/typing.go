@@ -0,0 +1,223 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kooroshh/fiber-boostrap/app/models"
+)
+
+type typingKey struct {
+	client       *Client
+	conversation string
+}
+
+// typingState is an active typing indicator of one client in one conversation.
+type typingState struct {
+	payload    models.TypingPayload
+	recipients []string
+	lastFanout time.Time
+	timer      *time.Timer
+}
+
+// typingTracker keeps the active typing indicators. A typing.start is fanned out at
+// most once per throttle interval per client and conversation, and an indicator that
+// is not refreshed within the timeout is stopped as if the client sent typing.stop.
+type typingTracker struct {
+	hub      *Hub
+	throttle time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+func newTypingTracker(hub *Hub, throttle time.Duration, timeout time.Duration) *typingTracker {
+	return &typingTracker{
+		hub:      hub,
+		throttle: throttle,
+		timeout:  timeout,
+		active:   make(map[typingKey]*typingState),
+	}
+}
+
+// start refreshes the indicator of the client in the conversation and tells the other
+// participants, unless they were told less than a throttle interval ago.
+func (t *typingTracker) start(key typingKey, payload models.TypingPayload, recipients []string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if ok {
+		state.timer.Reset(t.timeout)
+		if now.Sub(state.lastFanout) < t.throttle {
+			t.mu.Unlock()
+			return
+		}
+	} else {
+		state = &typingState{payload: payload, recipients: recipients}
+		state.timer = time.AfterFunc(t.timeout, func() {
+			t.expire(key, state)
+		})
+		t.active[key] = state
+	}
+	state.lastFanout = now
+	t.mu.Unlock()
+
+	t.fanout(state, models.TypingStateStart)
+}
+
+// refresh extends an active indicator that was fanned out less than a throttle
+// interval ago and reports whether it did so.
+func (t *typingTracker) refresh(key typingKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.active[key]
+	if !ok || time.Since(state.lastFanout) >= t.throttle {
+		return false
+	}
+	state.timer.Reset(t.timeout)
+	return true
+}
+
+// stop removes the indicator of the client in the conversation and tells the other
+// participants. It is a no-op when the client is not typing there.
+func (t *typingTracker) stop(key typingKey) {
+	t.mu.Lock()
+	state, ok := t.active[key]
+	if ok {
+		state.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		t.fanout(state, models.TypingStateStop)
+	}
+}
+
+// stopClient stops every indicator of a client, used when it disconnects.
+func (t *typingTracker) stopClient(client *Client) {
+	t.mu.Lock()
+	var keys []typingKey
+	for key := range t.active {
+		if key.client == client {
+			keys = append(keys, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, key := range keys {
+		t.stop(key)
+	}
+}
+
+// expire stops an indicator whose timeout elapsed, unless it was stopped or replaced
+// in the meantime.
+func (t *typingTracker) expire(key typingKey, state *typingState) {
+	t.mu.Lock()
+	current, ok := t.active[key]
+	if !ok || current != state {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.active, key)
+	t.mu.Unlock()
+
+	t.fanout(state, models.TypingStateStop)
+}
+
+func (t *typingTracker) fanout(state *typingState, status string) {
+	payload := state.payload
+	payload.State = status
+
+	var err error
+	if state.recipients == nil {
+		err = t.hub.BroadcastExcept(payload.Username, models.EventTyping, payload)
+	} else {
+		err = t.hub.BroadcastTo(state.recipients, models.EventTyping, payload)
+	}
+	if err != nil {
+		log.Printf("failed to fan out typing of %s: %v", payload.Username, err)
+	}
+}
+
+// handleTypingStart fans out a typing indicator to the other participants of the
+// conversation given by room_id or to, or of the global channel when both are empty.
+func handleTypingStart(ctx context.Context, client *Client, env models.Envelope) error {
+	payload, err := decodeTyping(client, env)
+	if err != nil {
+		return err
+	}
+
+	// Refreshes within the throttle interval neither hit the database nor fan out.
+	key := typingKey{client: client, conversation: typingConversation(payload)}
+	if client.hub.typing.refresh(key) {
+		return nil
+	}
+
+	recipients, _, err := resolveConversation(ctx, client, payload.RoomID, payload.To)
+	if err != nil {
+		return err
+	}
+	client.hub.typing.start(key, payload, otherParticipants(recipients, client.Username))
+	return nil
+}
+
+// handleTypingStop ends the typing indicator of the client in the conversation.
+func handleTypingStop(ctx context.Context, client *Client, env models.Envelope) error {
+	payload, err := decodeTyping(client, env)
+	if err != nil {
+		return err
+	}
+	client.hub.typing.stop(typingKey{client: client, conversation: typingConversation(payload)})
+	return nil
+}
+
+func decodeTyping(client *Client, env models.Envelope) (models.TypingPayload, error) {
+	var payload models.TypingPayload
+	if len(env.Data) > 0 {
+		if err := json.Unmarshal(env.Data, &payload); err != nil {
+			return payload, NewEventError(models.ErrorCodeBadRequest, "invalid typing event: %v", err)
+		}
+	}
+	if payload.RoomID != 0 && payload.To != "" {
+		return payload, NewEventError(models.ErrorCodeBadRequest, "a typing event cannot have both a room and a recipient")
+	}
+	payload.Username = client.Username
+	payload.State = ""
+	return payload, nil
+}
+
+// typingConversation identifies the conversation a typing event refers to as seen
+// by its sender.
+func typingConversation(payload models.TypingPayload) string {
+	switch {
+	case payload.RoomID != 0:
+		return fmt.Sprintf("room:%d", payload.RoomID)
+	case payload.To != "":
+		return "to:" + payload.To
+	default:
+		return "global"
+	}
+}
+
+// otherParticipants returns recipients without username. A nil list, meaning the
+// global channel, is returned as is.
+func otherParticipants(recipients []string, username string) []string {
+	if recipients == nil {
+		return nil
+	}
+	others := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if recipient != username {
+			others = append(others, recipient)
+		}
+	}
+	return others
+}
@@ -4,20 +4,35 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/template/html/v2"
+	"github.com/kooroshh/fiber-boostrap/app/controllers"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
 	"github.com/kooroshh/fiber-boostrap/app/ws"
 	"github.com/kooroshh/fiber-boostrap/pkg/database"
 	"github.com/kooroshh/fiber-boostrap/pkg/env"
+	"github.com/kooroshh/fiber-boostrap/pkg/jwt_token"
 	"github.com/kooroshh/fiber-boostrap/pkg/router"
 	"go.elastic.co/apm"
 )
 
-// NewApplication returns a new Fiber app with the following middleware:
+const (
+	defaultSessionCacheSize = 10000
+	defaultSessionCacheTTL  = time.Minute
+	sessionCachePrefix      = "langchatto:session"
+)
+
+// SessionCache caches the session lookups of the authentication middleware. It is
+// created by SetupSessionCache and nil when the cache is disabled.
+var SessionCache repository.SessionCache
+
+// NewApplication sets up the repositories chosen by SetupRepositories and returns a
+// new Fiber app with the following middleware:
 // - recover.New(): to recover from panics
 // - logger.New(): to log all requests
 // - monitor.New(): to expose metrics at /dashboard
@@ -26,9 +41,13 @@ import (
 func NewApplication() *fiber.App {
 	env.SetupEnvFile()
 	SetupLogFile()
+	jwt_token.SetupKeys()
 
-	database.SetupDatabase()
-	database.SetupMongoDB()
+	repos := SetupRepositories()
+	controllers.SetupRepositories(repos)
+	controllers.SetupLoginThrottle()
+	router.SetupRepositories(repos)
+	ws.SetupHub(repos)
 
 	apm.DefaultTracer.Service.Name = "langchatto-app"
 	engine := html.New("./views", ".html")
@@ -37,13 +56,74 @@ func NewApplication() *fiber.App {
 	app.Use(logger.New())
 	app.Get("/dashboard", monitor.New())
 
-	go ws.ServeWSMessaging(app)
+	ws.ServeWSMessaging(app, router.MiddlewareValidateWSAuth)
 
 	router.InstallRouter(app)
 
 	return app
 }
 
+// SetupRepositories returns the repositories selected by the APP_STORAGE environment
+// variable. With "database", the default, it connects to the SQL database and MongoDB
+// and returns repositories backed by them. With "memory" it returns in-memory
+// repositories that need no external services and lose their data on exit, which is
+// handy for local development and tests. Any other value terminates the program.
+// Session lookups go through the cache set up by SetupSessionCache.
+func SetupRepositories() repository.Repositories {
+	var repos repository.Repositories
+	switch storage := env.GetEnv("APP_STORAGE", "database"); storage {
+	case "database":
+		database.SetupDatabase()
+		database.SetupMongoDB()
+		repos = repository.NewDatabaseRepositories(database.DB, database.MongoDB, database.MongoReadMarker)
+	case "memory":
+		log.Println("Using in-memory storage, data is lost on exit")
+		repos = repository.NewMemoryRepositories()
+	default:
+		log.Fatalf("unknown APP_STORAGE %q, expected database or memory", storage)
+	}
+
+	if cache := SetupSessionCache(); cache != nil {
+		repos.Sessions = repository.NewCachedSessionRepository(repos.Sessions, cache)
+	}
+	return repos
+}
+
+// SetupSessionCache creates SessionCache from the SESSION_CACHE environment variable:
+// "memory", the default, keeps up to SESSION_CACHE_SIZE sessions in process, "redis"
+// adds a tier in the Redis server at REDIS_URL shared by every instance, and "off"
+// disables the cache and returns nil. Sessions stay cached for SESSION_CACHE_TTL at
+// most, e.g. "1m". Revoked sessions are dropped from the cache right away. If the cache
+// cannot be set up, the function logs a fatal error and terminates the program.
+func SetupSessionCache() repository.SessionCache {
+	size := env.GetInt("SESSION_CACHE_SIZE", defaultSessionCacheSize)
+	if size <= 0 {
+		log.Printf("invalid SESSION_CACHE_SIZE, using %d", defaultSessionCacheSize)
+		size = defaultSessionCacheSize
+	}
+	ttl := env.GetDuration("SESSION_CACHE_TTL", defaultSessionCacheTTL)
+	if ttl <= 0 {
+		log.Printf("invalid SESSION_CACHE_TTL, using %s", defaultSessionCacheTTL)
+		ttl = defaultSessionCacheTTL
+	}
+
+	switch kind := env.GetEnv("SESSION_CACHE", "memory"); kind {
+	case "memory":
+		SessionCache = repository.NewLRUSessionCache(size, ttl)
+	case "redis":
+		cache, err := repository.NewRedisSessionCache(env.GetEnv("REDIS_URL", "redis://localhost:6379/0"), sessionCachePrefix, size, ttl)
+		if err != nil {
+			log.Fatal("Failed to set up session cache: ", err)
+		}
+		SessionCache = cache
+	case "off":
+		SessionCache = nil
+	default:
+		log.Fatalf("unknown SESSION_CACHE %q, expected memory, redis or off", kind)
+	}
+	return SessionCache
+}
+
 // SetupLogFile configures the logging system to write logs to both the standard
 // output and a file named "langchatto-app.log" located in the "logs" directory.
 // If the log file does not exist, it will be created. If there is an error
@@ -0,0 +1,83 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/controllers"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
+	"github.com/kooroshh/fiber-boostrap/pkg/database"
+	"github.com/kooroshh/fiber-boostrap/pkg/env"
+)
+
+const defaultShutdownTimeout = 15 * time.Second
+
+// Serve starts serving app, HTTP API and WebSocket alike, on APP_HOST:APP_PORT and,
+// when APP_PORT_SOCKET is set to a different port, on that port as well. It blocks
+// until the process receives SIGINT or SIGTERM or a listener fails, then shuts down
+// gracefully, see Shutdown. Forgotten failed login counters are purged in the
+// background meanwhile. It returns the error of the failed listener, if any.
+func Serve(app *fiber.App) error {
+	host := env.GetEnv("APP_HOST", "localhost")
+	ports := []string{env.GetEnv("APP_PORT", "4000")}
+	if socketPort := env.GetEnv("APP_PORT_SOCKET", ""); socketPort != "" && socketPort != ports[0] {
+		ports = append(ports, socketPort)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go controllers.PurgeLoginThrottles(ctx)
+
+	listenErr := make(chan error, len(ports))
+	for _, port := range ports {
+		go func(addr string) {
+			listenErr <- app.Listen(addr)
+		}(fmt.Sprintf("%s:%s", host, port))
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err = <-listenErr:
+		log.Println("listener failed, shutting down: ", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.GetDuration("APP_SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+	defer cancel()
+	Shutdown(shutdownCtx, app)
+
+	return err
+}
+
+// Shutdown stops app in order: the listeners are closed and running HTTP requests
+// finish, every WebSocket is closed with a going away close frame and pending MongoDB
+// writes of the hub are awaited, then the session cache and the database clients are
+// closed. Steps that do not finish before ctx is done are abandoned and logged.
+func Shutdown(ctx context.Context, app *fiber.App) {
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		log.Println("failed to shut down server: ", err)
+	}
+	if err := ws.DefaultHub.Shutdown(ctx); err != nil {
+		log.Println("failed to drain websocket connections: ", err)
+	}
+	if SessionCache != nil {
+		if err := SessionCache.Close(); err != nil {
+			log.Println("failed to close session cache: ", err)
+		}
+	}
+	if err := database.CloseMongoDB(ctx); err != nil {
+		log.Println("failed to close mongodb client: ", err)
+	}
+	if err := database.CloseDatabase(); err != nil {
+		log.Println("failed to close database: ", err)
+	}
+	log.Println("shutdown complete")
+}
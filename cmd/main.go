@@ -1,19 +1,18 @@
 package main
 
 import (
-	"fmt"
-	"github.com/kooroshh/fiber-boostrap/bootstrap"
-	"github.com/kooroshh/fiber-boostrap/pkg/env"
 	"log"
+
+	"github.com/kooroshh/fiber-boostrap/bootstrap"
 )
 
-// main initializes and starts the Fiber application by creating a new
-// application instance using the bootstrap package and then listens on
-// the specified host and port defined in the environment variables.
-// If the application fails to start, it logs the error and terminates
-// the program.
+// main initializes the Fiber application by creating a new application
+// instance using the bootstrap package and serves it until the process is
+// asked to stop, see bootstrap.Serve. If a listener fails, it logs the error
+// and terminates the program once the application is shut down.
 func main() {
 	app := bootstrap.NewApplication()
-	log.Fatal(app.Listen(fmt.Sprintf("%s:%s", env.GetEnv("APP_HOST", "localhost"), env.GetEnv("APP_PORT", "4000"))))
+	if err := bootstrap.Serve(app); err != nil {
+		log.Fatal(err)
+	}
 }
-
@@ -7,4 +7,8 @@ import (
 
 var DB *gorm.DB
 
+var MongoClient *mongo.Client
+
 var MongoDB *mongo.Collection
+
+var MongoReadMarker *mongo.Collection
@@ -8,6 +8,7 @@ import (
 
 	"github.com/kooroshh/fiber-boostrap/app/models"
 	"github.com/kooroshh/fiber-boostrap/pkg/env"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"gorm.io/driver/mysql"
@@ -31,17 +32,45 @@ func SetupDatabase() {
 
 	DB.Logger = logger.Default.LogMode(logger.Info)
 
-	err = DB.AutoMigrate(&models.User{}, &models.UserSession{})
+	err = DB.AutoMigrate(&models.User{}, &models.UserSession{}, &models.RetiredRefreshToken{}, &models.SecurityEvent{}, &models.LoginThrottle{}, &models.Room{}, &models.RoomMember{})
 	if err != nil {
 		log.Fatal("Failed to migrate database: ", err)
 	}
 
+	// Sessions used to store their tokens in plain text, they are hashed now, see
+	// models.HashToken. Sessions created before have to log in again.
+	dropPlainTokens(&models.UserSession{}, "token", "refresh_token")
+	dropPlainTokens(&models.RetiredRefreshToken{}, "refresh_token")
+
 	log.Println("successfully migrate database!")
 }
 
+// dropPlainTokens deletes the rows of the table of model that have no token hash yet
+// and drops the given plain token columns, unless that already happened. If the
+// migration fails, it logs the error and exits the program.
+func dropPlainTokens(model interface{}, columns ...string) {
+	if !DB.Migrator().HasColumn(model, columns[0]) {
+		return
+	}
+	err := DB.Where("refresh_token_hash IS NULL").Delete(model).Error
+	if err != nil {
+		log.Fatal("Failed to migrate database: ", err)
+	}
+	for _, column := range columns {
+		if err = DB.Migrator().DropColumn(model, column); err != nil {
+			log.Fatal("Failed to migrate database: ", err)
+		}
+	}
+}
+
 // SetupMongoDB sets up the MongoDB client with the given MONGODB_URI
-// environment variable and stores the message_history collection in the
-// MongoDB variable. If the connection fails, it panics.
+// environment variable, stores it in the MongoClient variable and the
+// message_history collection in the MongoDB variable. It also creates the indexes used to page through the history
+// by date, per room, per direct conversation and per thread, the text index used by
+// the message search and the unique index that makes sends with a client_msg_id
+// idempotent. The read_markers collection, holding one read marker per user and
+// conversation, is stored in the MongoReadMarker variable. If the connection or the
+// index creation fails, it panics.
 func SetupMongoDB() {
 	uri := env.GetEnv("MONGODB_URI", "")
 
@@ -50,8 +79,66 @@ func SetupMongoDB() {
 	if err != nil {
 		panic(err)
 	}
+	MongoClient = client
 	coll := client.Database("LangChatto_DB").Collection("message_history")
 	MongoDB = coll
 
+	_, err = coll.Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "date", Value: -1}, {Key: "_id", Value: -1}}},
+		{
+			Keys: bson.D{{Key: "from", Value: 1}, {Key: "client_msg_id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "client_msg_id", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetPartialFilterExpression(bson.D{{Key: "room_id", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "conversation_id", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetPartialFilterExpression(bson.D{{Key: "conversation_id", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys:    bson.D{{Key: "thread_root", Value: 1}, {Key: "date", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetPartialFilterExpression(bson.D{{Key: "thread_root", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+		{Keys: bson.D{{Key: "message", Value: "text"}}},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	MongoReadMarker = client.Database("LangChatto_DB").Collection("read_markers")
+	_, err = MongoReadMarker.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}, {Key: "conversation", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		panic(err)
+	}
+
 	log.Println("Successfully connected to MongoDB")
 }
+
+// CloseDatabase closes the connection pool of the SQL database. Queries still running
+// are allowed to finish. It does nothing when the database was never set up.
+func CloseDatabase() error {
+	if DB == nil {
+		return nil
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// CloseMongoDB disconnects the MongoDB client, waiting for in-use connections to be
+// returned to the pool until ctx is done. It does nothing when MongoDB was never set
+// up.
+func CloseMongoDB(ctx context.Context) error {
+	if MongoClient == nil {
+		return nil
+	}
+	return MongoClient.Disconnect(ctx)
+}
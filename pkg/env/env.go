@@ -1,6 +1,12 @@
 package env
 
-import "github.com/joho/godotenv"
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
 
 var Env map[string]string
 
@@ -12,6 +18,29 @@ func GetEnv(key, def string) string {
 	return def
 }
 
+// GetInt retrieves the value of a specific environment variable as an integer, or a default value if the variable
+// does not exist. An invalid value is logged and the default value is returned.
+func GetInt(key string, def int) int {
+	val, err := strconv.Atoi(GetEnv(key, strconv.Itoa(def)))
+	if err != nil {
+		log.Printf("invalid %s: %v", key, err)
+		return def
+	}
+	return val
+}
+
+// GetDuration retrieves the value of a specific environment variable as a duration in time.ParseDuration syntax,
+// e.g. "15m", or a default value if the variable does not exist. An invalid value is logged and the default value
+// is returned.
+func GetDuration(key string, def time.Duration) time.Duration {
+	val, err := time.ParseDuration(GetEnv(key, def.String()))
+	if err != nil {
+		log.Printf("invalid %s: %v", key, err)
+		return def
+	}
+	return val
+}
+
 // SetupEnvFile loads the .env file and populates the Env map with the key-value pairs in the file.
 // If the file does not exist or there is an error reading the file, the function panics.
 func SetupEnvFile() {
@@ -2,6 +2,8 @@ package jwt_token
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -21,38 +23,62 @@ var MapTypeToken = map[string]time.Duration{
 	"refresh_token": time.Hour * 72,
 }
 
-var jwtSecret = []byte(env.GetEnv("APP_SECRET", ""))
-
 // GenerateToken generates a JWT token given a username, fullname, tokenType, and a current time.
 // tokenType can be either "token" or "refresh_token". The token will be expired according to the
-// duration specified in MapTypeToken.
+// duration specified in MapTypeToken. Every token gets a random ID, so two tokens issued for the
+// same user in the same second still differ. The token is signed with the key of the key set
+// that is active at now and names it in its kid header.
 func GenerateToken(ctx context.Context, username string, fullname string, tokenType string, now time.Time) (string, error) {
 	span, _ := apm.StartSpan(ctx, "GenerateToken", "jwt")
 	defer span.End()
 
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token id: %v", err)
+	}
+
 	claimToken := ClaimToken{
 		Username: username,
 		Fullname: fullname,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			Issuer:    env.GetEnv("APP_NAME", ""),
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(MapTypeToken[tokenType])),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claimToken)
+	key, err := keys.signingKey(now)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
 
-	resultToken, err := token.SignedString(jwtSecret)
+	token := jwt.NewWithClaims(key.Method, claimToken)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+
+	resultToken, err := token.SignedString(key.signKey)
 	if err != nil {
 		return resultToken, fmt.Errorf("failed to generate token: %v", err)
 	}
 	return resultToken, nil
 }
 
+// newTokenID returns a random identifier for the jti claim of a token.
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
 // ValidateToken validates a JWT token given in the argument and returns a ClaimToken struct if the
 // validation is successful. If the validation fails, it returns an error.
 //
-// This function uses the APP_SECRET environment variable as the secret key.
+// The token must be signed with a key of the key set that is not retired, named by its kid
+// header, or with the HS256 secret when it has no kid. Its algorithm must match the key.
 func ValidateToken(ctx context.Context, token string) (*ClaimToken, error) {
 	span, _ := apm.StartSpan(ctx, "ValidateToken", "jwt")
 	defer span.End()
@@ -62,12 +88,7 @@ func ValidateToken(ctx context.Context, token string) (*ClaimToken, error) {
 		ok         bool
 	)
 
-	jwtToken, err := jwt.ParseWithClaims(token, &ClaimToken{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("failed to validate method jwt: %v", t.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	jwtToken, err := jwt.ParseWithClaims(token, &ClaimToken{}, keys.verificationKey)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse jwt: %v", err)
@@ -0,0 +1,243 @@
+package jwt_token
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kooroshh/fiber-boostrap/pkg/env"
+)
+
+const minRSAKeyBits = 2048
+
+// Key is a key tokens are signed or verified with. Tokens signed with it carry its ID
+// in the kid header. A key signs the tokens issued from ActiveFrom until a newer key
+// becomes active, and verifies tokens until RetireAt. Keeping a key after its
+// successor is active, for at least the lifetime of a refresh token, lets the tokens
+// it signed expire naturally.
+type Key struct {
+	ID         string
+	Method     jwt.SigningMethod
+	ActiveFrom time.Time
+	RetireAt   time.Time
+
+	// signKey is nil for keys that only verify.
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// retired reports whether the key no longer verifies tokens at now.
+func (k *Key) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// KeySet holds the keys tokens are signed and verified with.
+type KeySet struct {
+	// keys is sorted by ActiveFrom.
+	keys []*Key
+}
+
+// keyFileEntry is a key as listed in the keys file.
+type keyFileEntry struct {
+	ID         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	PrivateKey string    `json:"private_key"`
+	PublicKey  string    `json:"public_key"`
+	ActiveFrom time.Time `json:"active_from"`
+	RetireAt   time.Time `json:"retire_at"`
+}
+
+// keys is the key set used by GenerateToken and ValidateToken. It is created by
+// SetupKeys.
+var keys *KeySet
+
+// SetupKeys loads the signing keys from the environment and must be called after the
+// env file is loaded. JWT_KEYS_FILE names a JSON file listing the RS256 and EdDSA keys,
+// see LoadKeySet. When it is not set, tokens are signed with HS256 using APP_SECRET.
+// When it is set, APP_SECRET is optional and only verifies the HS256 tokens issued
+// before the switch. If the keys cannot be loaded, the function logs a fatal error
+// and terminates the program.
+func SetupKeys() {
+	set, err := LoadKeySet(env.GetEnv("JWT_KEYS_FILE", ""), env.GetEnv("APP_SECRET", ""))
+	if err != nil {
+		log.Fatal("Failed to load jwt keys: ", err)
+	}
+	keys = set
+
+	key, err := keys.signingKey(time.Now())
+	if err != nil {
+		log.Fatal("Failed to load jwt keys: ", err)
+	}
+	if key.ID == "" {
+		log.Println("Signing tokens with HS256 using APP_SECRET")
+		return
+	}
+	log.Printf("Signing tokens with %s key %q", key.Method.Alg(), key.ID)
+}
+
+// LoadKeySet creates a key set from the keys file at path and the HS256 secret.
+//
+// The keys file holds a JSON object whose "keys" array lists, for every key, its
+// "kid", its "alg" (RS256 or EdDSA), the PEM file of its "private_key" or, for keys
+// that only verify, of its "public_key", and optionally the RFC 3339 times
+// "active_from" and "retire_at". Relative paths are resolved against the directory of
+// the keys file. To rotate, add the new key with an active_from in the future and give
+// the current key a retire_at at least 72 hours, the lifetime of a refresh token,
+// after it; other services pick the new key up from the JWKS before it is used.
+//
+// When path is empty, tokens are signed and verified with HS256 using secret, which
+// must then be set. Otherwise secret may be empty; when it is set, HS256 tokens without
+// a kid still verify but no new ones are issued.
+func LoadKeySet(path string, secret string) (*KeySet, error) {
+	if path == "" {
+		if secret == "" {
+			return nil, fmt.Errorf("APP_SECRET or JWT_KEYS_FILE must be set")
+		}
+		hmacKey := &Key{Method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+		return &KeySet{keys: []*Key{hmacKey}}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keys file: %v", err)
+	}
+	var file struct {
+		Keys []keyFileEntry `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse keys file %s: %v", path, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("keys file %s lists no keys", path)
+	}
+
+	set := &KeySet{}
+	seen := make(map[string]bool)
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("key without kid in %s", path)
+		}
+		if seen[entry.ID] {
+			return nil, fmt.Errorf("duplicate kid %q in %s", entry.ID, path)
+		}
+		seen[entry.ID] = true
+
+		key, err := loadKey(entry, filepath.Dir(path))
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", entry.ID, err)
+		}
+		set.keys = append(set.keys, key)
+	}
+
+	if secret != "" {
+		set.keys = append(set.keys, &Key{Method: jwt.SigningMethodHS256, verifyKey: []byte(secret)})
+	}
+	sort.SliceStable(set.keys, func(i, j int) bool {
+		return set.keys[i].ActiveFrom.Before(set.keys[j].ActiveFrom)
+	})
+	return set, nil
+}
+
+// loadKey reads the PEM files of entry, resolving relative paths against dir.
+func loadKey(entry keyFileEntry, dir string) (*Key, error) {
+	key := &Key{ID: entry.ID, ActiveFrom: entry.ActiveFrom, RetireAt: entry.RetireAt}
+	if !key.RetireAt.IsZero() && !key.RetireAt.After(key.ActiveFrom) {
+		return nil, fmt.Errorf("retire_at must be after active_from")
+	}
+
+	var (
+		file    = entry.PrivateKey
+		private = true
+	)
+	if file == "" {
+		file, private = entry.PublicKey, false
+	}
+	if file == "" {
+		return nil, fmt.Errorf("private_key or public_key is required")
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	pemData, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	switch entry.Algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		key.Method = jwt.SigningMethodRS256
+		var public *rsa.PublicKey
+		if private {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, public = privateKey, &privateKey.PublicKey
+		} else if public, err = jwt.ParseRSAPublicKeyFromPEM(pemData); err != nil {
+			return nil, err
+		}
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("rsa key must have at least %d bits", minRSAKeyBits)
+		}
+		key.verifyKey = public
+	case jwt.SigningMethodEdDSA.Alg():
+		key.Method = jwt.SigningMethodEdDSA
+		if private {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemData)
+			if err != nil {
+				return nil, err
+			}
+			edKey, ok := privateKey.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("private key is not an Ed25519 key")
+			}
+			key.signKey, key.verifyKey = edKey, edKey.Public()
+		} else {
+			publicKey, err := jwt.ParseEdPublicKeyFromPEM(pemData)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = publicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported alg %q, expected RS256 or EdDSA", entry.Algorithm)
+	}
+	return key, nil
+}
+
+// signingKey returns the key tokens issued at now are signed with: the most recently
+// activated key that can sign and is not retired.
+func (s *KeySet) signingKey(now time.Time) (*Key, error) {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		key := s.keys[i]
+		if key.signKey != nil && !key.ActiveFrom.After(now) && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no jwt key is active for signing")
+}
+
+// verificationKey is the jwt.Keyfunc of ValidateToken. It returns the key named by the
+// kid header of t, or the HS256 secret for tokens without a kid, provided the key is
+// not retired and t is signed with the algorithm of the key.
+func (s *KeySet) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	now := time.Now()
+	for _, key := range s.keys {
+		if key.ID != kid || key.retired(now) {
+			continue
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("failed to validate method jwt: %v", t.Header["alg"])
+		}
+		return key.verifyKey, nil
+	}
+	return nil, fmt.Errorf("unknown jwt key %q", kid)
+}
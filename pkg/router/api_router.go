@@ -4,20 +4,25 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/kooroshh/fiber-boostrap/app/controllers"
+	"github.com/kooroshh/fiber-boostrap/app/models"
 	"go.elastic.co/apm/module/apmfiber"
 )
 
 type ApiRouter struct {
 }
 
-// InstallRouter registers all the routes under /api/* and /message/*
+// InstallRouter registers all the routes under /api/*, /user/*, /message/* and /room/*,
+// and the JWKS at /.well-known/jwks.json
 func (h ApiRouter) InstallRouter(app *fiber.App) {
+	app.Get("/.well-known/jwks.json", controllers.GetJWKS)
+
 	api := app.Group("/api", limiter.New())
 	api.Get("/", func(ctx *fiber.Ctx) error {
 		return ctx.Status(fiber.StatusOK).JSON(fiber.Map{
 			"message": "Hello from api",
 		})
 	})
+	api.Get("/metrics/ws", controllers.GetWSMetrics)
 
 	userGroup := app.Group("/user")
 	userGroup.Use(apmfiber.Middleware())
@@ -26,11 +31,34 @@ func (h ApiRouter) InstallRouter(app *fiber.App) {
 	userV1Group.Post("/login", controllers.Login)
 	userV1Group.Delete("/logout", MiddlewareValidateAuth, controllers.Logout)
 	userV1Group.Put("/refresh-token", MiddlewareRefreshToken, controllers.RefreshToken)
+	userV1Group.Get("/presence", MiddlewareValidateAuth, controllers.GetPresence)
+	userV1Group.Get("/sessions", MiddlewareValidateAuth, controllers.GetSessions)
+	userV1Group.Delete("/sessions", MiddlewareValidateAuth, controllers.RevokeAllSessions)
+	userV1Group.Delete("/sessions/:id", MiddlewareValidateAuth, controllers.RevokeSession)
+	userV1Group.Post("/users/:username/unlock", MiddlewareValidateAuth, MiddlewareRequireRole(models.RoleAdmin), controllers.UnlockUser)
 
 	messageGroup := app.Group("/message")
 	messageGroup.Use(apmfiber.Middleware())
 	messageV1Group := messageGroup.Group("/v1")
 	messageV1Group.Get("/history", MiddlewareValidateAuth, controllers.GetHistory)
+	messageV1Group.Get("/direct/:username", MiddlewareValidateAuth, controllers.GetDirectHistory)
+	messageV1Group.Get("/search", MiddlewareValidateAuth, controllers.SearchMessages)
+	messageV1Group.Get("/read-marker", MiddlewareValidateAuth, controllers.GetReadMarker)
+	messageV1Group.Put("/read-marker", MiddlewareValidateAuth, controllers.UpdateReadMarker)
+	messageV1Group.Put("/:id", MiddlewareValidateAuth, controllers.EditMessage)
+	messageV1Group.Delete("/:id", MiddlewareValidateAuth, controllers.DeleteMessage)
+	messageV1Group.Get("/:id/thread", MiddlewareValidateAuth, controllers.GetThread)
+	messageV1Group.Post("/:id/reactions", MiddlewareValidateAuth, controllers.AddReaction)
+	messageV1Group.Delete("/:id/reactions/:emoji", MiddlewareValidateAuth, controllers.RemoveReaction)
+
+	roomGroup := app.Group("/room")
+	roomGroup.Use(apmfiber.Middleware())
+	roomV1Group := roomGroup.Group("/v1", MiddlewareValidateAuth)
+	roomV1Group.Post("/", controllers.CreateRoom)
+	roomV1Group.Get("/", controllers.GetRooms)
+	roomV1Group.Post("/:id/join", controllers.JoinRoom)
+	roomV1Group.Delete("/:id/leave", controllers.LeaveRoom)
+	roomV1Group.Post("/:id/members", controllers.AddRoomMember)
 }
 
 // NewApiRouter creates and returns a new instance of ApiRouter.
@@ -1,23 +1,42 @@
 package router
 
 import (
+	"context"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/models"
 	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
 	"github.com/kooroshh/fiber-boostrap/pkg/jwt_token"
 	"github.com/kooroshh/fiber-boostrap/pkg/response"
 	"go.elastic.co/apm"
 )
 
+// sessionTouchInterval is how stale the last used time of a session may get.
+const sessionTouchInterval = time.Minute
+
+// repos holds the repositories the middleware look sessions up in.
+var repos repository.Repositories
+
+// SetupRepositories sets the repositories used by the middleware. It must be called
+// before the routes are served.
+func SetupRepositories(r repository.Repositories) {
+	repos = r
+}
+
 // MiddlewareValidateAuth is a middleware that validates the authorization header
 // on each request. If the header is empty, it returns a 401 Unauthorized response.
-// If the header is not empty, it attempts to retrieve the corresponding user session
-// from the database. If the retrieval is successful, it validates the JWT token
-// using the ValidateToken function. If the validation is successful, it sets the
-// username and full_name locals on the request context and calls the next handler.
-// If the validation fails, it returns a 401 Unauthorized response.
+// If the header is not empty, it validates the JWT token using the ValidateToken
+// function first, so that forged or expired tokens never reach the database. If the
+// validation is successful, it retrieves the corresponding user session, from the
+// session cache when it holds it. If the session exists, it sets the user_id,
+// username, full_name and session_id locals on the request context, records that the
+// session was used and calls the next handler. Otherwise, it returns a 401
+// Unauthorized response.
 func MiddlewareValidateAuth(ctx *fiber.Ctx) error {
 	span, spanCtx := apm.StartSpan(ctx.Context(), "MiddlewareValidateAuth", "middleware")
 	defer span.End()
@@ -28,9 +47,52 @@ func MiddlewareValidateAuth(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
 	}
 
-	_, err := repository.GetUserSessionByToken(spanCtx, auth)
+	claim, err := jwt_token.ValidateToken(spanCtx, auth)
+	if err != nil {
+		log.Println(err)
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+
+	if time.Now().Unix() > claim.ExpiresAt.Unix() {
+		log.Println("jwt token is expired: ", claim.ExpiresAt)
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+
+	session, err := repos.Sessions.GetUserSessionByToken(spanCtx, auth)
 	if err != nil {
-		log.Println("failed to get user session on DB: ", err)
+		log.Println("failed to get user session: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+
+	touchSession(spanCtx, session)
+
+	ctx.Locals("user_id", session.UserID)
+	ctx.Locals("username", claim.Username)
+	ctx.Locals("full_name", claim.Fullname)
+	ctx.Locals("session_id", session.ID)
+
+	return ctx.Next()
+}
+
+// MiddlewareValidateWSAuth is a middleware that guards the WebSocket handshake.
+// It rejects requests that are not WebSocket upgrades, then reads the access token
+// from the Authorization header, the "access_token" subprotocol or the "token"
+// query parameter, in that order. The token must pass the same JWT validation as
+// MiddlewareValidateAuth and belong to an existing user session. On success it sets the
+// user_id, username, full_name and session_id locals, which the upgraded connection
+// inherits, and calls the next handler. Otherwise it returns a 401 Unauthorized
+// response before the connection is upgraded.
+func MiddlewareValidateWSAuth(ctx *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(ctx) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	span, spanCtx := apm.StartSpan(ctx.Context(), "MiddlewareValidateWSAuth", "middleware")
+	defer span.End()
+
+	auth := wsAuthToken(ctx)
+	if auth == "" {
+		log.Println("websocket authorization empty")
 		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
 	}
 
@@ -45,12 +107,78 @@ func MiddlewareValidateAuth(ctx *fiber.Ctx) error {
 		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
 	}
 
+	session, err := repos.Sessions.GetUserSessionByToken(spanCtx, auth)
+	if err != nil {
+		log.Println("failed to get user session: ", err)
+		return response.SendFailureResponse(ctx, fiber.StatusUnauthorized, "unauthorized", nil)
+	}
+
+	touchSession(spanCtx, session)
+
+	ctx.Locals("user_id", session.UserID)
 	ctx.Locals("username", claim.Username)
 	ctx.Locals("full_name", claim.Fullname)
+	ctx.Locals("session_id", session.ID)
 
 	return ctx.Next()
 }
 
+// MiddlewareRequireRole returns a middleware that only lets users with the given role
+// through. It must run after MiddlewareValidateAuth, which sets the username local.
+// The role is read from the database, so that a revoked role takes effect right away.
+// Other users get a 403 Forbidden response.
+func MiddlewareRequireRole(role string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		span, spanCtx := apm.StartSpan(ctx.Context(), "MiddlewareRequireRole", "middleware")
+		defer span.End()
+
+		user, err := repos.Users.GetUserByUsername(spanCtx, ctx.Locals("username").(string))
+		if err != nil {
+			log.Println("failed to get user by username: ", err)
+			return response.SendFailureResponse(ctx, fiber.StatusForbidden, "forbidden", nil)
+		}
+
+		if user.Role != role {
+			log.Printf("%s lacks role %s", user.Username, role)
+			return response.SendFailureResponse(ctx, fiber.StatusForbidden, "forbidden", nil)
+		}
+
+		return ctx.Next()
+	}
+}
+
+// touchSession records that session was just used. To spare the database a write per
+// request, the time is only stored once it is more than sessionTouchInterval old.
+// Failing to store it does not fail the request.
+func touchSession(ctx context.Context, session models.UserSession) {
+	now := time.Now()
+	if now.Sub(session.LastUsedAt) < sessionTouchInterval {
+		return
+	}
+	if err := repos.Sessions.UpdateUserSessionLastUsed(ctx, session.ID, now); err != nil {
+		log.Println("failed to update session last used: ", err)
+	}
+}
+
+// wsAuthToken extracts the access token of a WebSocket handshake. Browsers cannot
+// set headers on a WebSocket request, so besides the Authorization header the token
+// is accepted as the value following the "access_token" subprotocol or as the
+// "token" query parameter.
+func wsAuthToken(ctx *fiber.Ctx) string {
+	if auth := ctx.Get("authorization"); auth != "" {
+		return auth
+	}
+
+	protocols := strings.Split(ctx.Get("Sec-WebSocket-Protocol"), ",")
+	for i := 0; i < len(protocols)-1; i++ {
+		if strings.TrimSpace(protocols[i]) == ws.AuthSubprotocol {
+			return strings.TrimSpace(protocols[i+1])
+		}
+	}
+
+	return ctx.Query("token")
+}
+
 // MiddlewareRefreshToken is a middleware that validates the authorization header
 // on each request. If the header is empty, it returns a 401 Unauthorized response.
 // If the header is not empty, it attempts to retrieve the corresponding user session
@@ -0,0 +1,615 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/kooroshh/fiber-boostrap/app/controllers"
+	"github.com/kooroshh/fiber-boostrap/app/models"
+	"github.com/kooroshh/fiber-boostrap/app/repository"
+	"github.com/kooroshh/fiber-boostrap/app/ws"
+	"github.com/kooroshh/fiber-boostrap/pkg/env"
+	"github.com/kooroshh/fiber-boostrap/pkg/jwt_token"
+	"go.elastic.co/apm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "password1"
+
+type testResponse struct {
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func TestMain(m *testing.M) {
+	// There is no APM server in tests, and the tracer would read the request buffers
+	// fasthttp already reuses for the next request.
+	apm.DefaultTracer.SetRecording(false)
+	os.Exit(m.Run())
+}
+
+// newTestApp wires the routes to fresh in-memory repositories, the way
+// bootstrap.NewApplication does with the configured storage.
+func newTestApp(t *testing.T) (*fiber.App, repository.Repositories) {
+	t.Helper()
+
+	return newTestAppWithEnv(t, map[string]string{"APP_SECRET": "test secret"})
+}
+
+// newTestAppWithEnv is newTestApp with the given environment variables.
+func newTestAppWithEnv(t *testing.T, vars map[string]string) (*fiber.App, repository.Repositories) {
+	t.Helper()
+
+	env.Env = vars
+	jwt_token.SetupKeys()
+
+	repos := repository.NewMemoryRepositories()
+	controllers.SetupRepositories(repos)
+	controllers.SetupLoginThrottle()
+	SetupRepositories(repos)
+	ws.SetupHub(repos)
+	hub := ws.DefaultHub
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+
+	app := fiber.New()
+	InstallRouter(app)
+	return app, repos
+}
+
+// call sends a request with body encoded as JSON and token as Authorization header,
+// both optional, and decodes the response.
+func call(t *testing.T, app *fiber.App, method string, path string, token string, body interface{}) (int, testResponse) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, token)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var out testResponse
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("failed to decode response of %s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, out
+}
+
+// expectStatus calls the route and fails unless it answers with status, it returns the
+// data of the response.
+func expectStatus(t *testing.T, app *fiber.App, status int, method string, path string, token string, body interface{}) json.RawMessage {
+	t.Helper()
+
+	got, resp := call(t, app, method, path, token, body)
+	if got != status {
+		t.Fatalf("%s %s = %d %q, want %d", method, path, got, resp.Message, status)
+	}
+	return resp.Data
+}
+
+func decode(t *testing.T, data json.RawMessage, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("failed to decode %s: %v", data, err)
+	}
+}
+
+func register(t *testing.T, app *fiber.App, username string) {
+	t.Helper()
+
+	expectStatus(t, app, http.StatusOK, http.MethodPost, "/user/v1/register", "", fiber.Map{
+		"username":  username,
+		"password":  testPassword,
+		"full_name": username + " tester",
+	})
+}
+
+func login(t *testing.T, app *fiber.App, username string) models.LoginResponse {
+	t.Helper()
+
+	var resp models.LoginResponse
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPost, "/user/v1/login", "", fiber.Map{
+		"username": username,
+		"password": testPassword,
+	}), &resp)
+	return resp
+}
+
+// createUser stores a user with role directly, since roles cannot be granted through
+// the API.
+func createUser(t *testing.T, repos repository.Repositories, username string, role string) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	err = repos.Users.InsertNewUser(context.Background(), &models.User{
+		Username: username,
+		Password: string(hash),
+		FullName: username + " tester",
+		Role:     role,
+	})
+	if err != nil {
+		t.Fatalf("InsertNewUser: %v", err)
+	}
+}
+
+// securityEventRecorder keeps the security events recorded by the controllers.
+type securityEventRecorder struct {
+	events []models.SecurityEvent
+}
+
+func (r *securityEventRecorder) InsertSecurityEvent(ctx context.Context, event *models.SecurityEvent) error {
+	r.events = append(r.events, *event)
+	return nil
+}
+
+func insertMessage(t *testing.T, repos repository.Repositories, from string, text string, date time.Time) models.MessagePayload {
+	t.Helper()
+
+	msg, _, err := repos.Messages.InsertNewMessage(context.Background(), models.MessagePayload{
+		Type:    models.MessageTypeText,
+		From:    from,
+		Message: text,
+		Date:    date,
+	})
+	if err != nil {
+		t.Fatalf("InsertNewMessage: %v", err)
+	}
+	return msg
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	register(t, app, "alice1")
+	expectStatus(t, app, http.StatusInternalServerError, http.MethodPost, "/user/v1/register", "", fiber.Map{
+		"username":  "alice1",
+		"password":  testPassword,
+		"full_name": "another alice",
+	})
+
+	tokens := login(t, app, "alice1")
+	if tokens.Username != "alice1" || tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Fatalf("got login response %+v", tokens)
+	}
+	expectStatus(t, app, http.StatusNotFound, http.MethodPost, "/user/v1/login", "", fiber.Map{
+		"username": "alice1",
+		"password": "wrong password",
+	})
+
+	var sessions []models.SessionResponse
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodGet, "/user/v1/sessions", tokens.Token, nil), &sessions)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("got sessions %+v, want the current one", sessions)
+	}
+}
+
+func TestMiddlewareValidateAuth(t *testing.T) {
+	app, _ := newTestApp(t)
+	register(t, app, "alice1")
+	tokens := login(t, app, "alice1")
+
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", "", nil)
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", "not a token", nil)
+	// A valid JWT without session, the refresh token is no access token.
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", tokens.RefreshToken, nil)
+
+	expectStatus(t, app, http.StatusOK, http.MethodDelete, "/user/v1/logout", tokens.Token, nil)
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", tokens.Token, nil)
+}
+
+func TestMiddlewareRequireRole(t *testing.T) {
+	app, repos := newTestApp(t)
+	createUser(t, repos, "admin1", models.RoleAdmin)
+	register(t, app, "alice1")
+	admin := login(t, app, "admin1")
+	alice := login(t, app, "alice1")
+
+	expectStatus(t, app, http.StatusForbidden, http.MethodPost, "/user/v1/users/alice1/unlock", alice.Token, nil)
+	expectStatus(t, app, http.StatusOK, http.MethodPost, "/user/v1/users/alice1/unlock", admin.Token, nil)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	app, repos := newTestApp(t)
+	events := &securityEventRecorder{}
+	repos.SecurityEvents = events
+	controllers.SetupRepositories(repos)
+	register(t, app, "alice1")
+	first := login(t, app, "alice1")
+
+	var second models.LoginResponse
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPut, "/user/v1/refresh-token", first.RefreshToken, nil), &second)
+	if second.Token == first.Token || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh did not rotate the tokens")
+	}
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", first.Token, nil)
+	expectStatus(t, app, http.StatusOK, http.MethodGet, "/user/v1/sessions", second.Token, nil)
+
+	// Presenting the retired refresh token again revokes the whole family.
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodPut, "/user/v1/refresh-token", first.RefreshToken, nil)
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", second.Token, nil)
+	expectStatus(t, app, http.StatusUnauthorized, http.MethodPut, "/user/v1/refresh-token", second.RefreshToken, nil)
+
+	if len(events.events) != 1 || events.events[0].Event != models.SecurityEventRefreshTokenReuse {
+		t.Fatalf("got security events %+v, want a refresh token reuse", events.events)
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	app, repos := newTestApp(t)
+	register(t, app, "alice1")
+	alice := login(t, app, "alice1")
+
+	// Messages sharing a millisecond must not be skipped at a page boundary.
+	date := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	var want []string
+	for i := 0; i < 7; i++ {
+		text := fmt.Sprintf("message %d", i)
+		insertMessage(t, repos, "alice1", text, date.Add(time.Duration(i/3)*time.Millisecond))
+		want = append(want, text)
+	}
+
+	var (
+		got    []string
+		cursor string
+	)
+	for page := 0; ; page++ {
+		path := "/message/v1/history?limit=3"
+		if cursor != "" {
+			path += "&before=" + url.QueryEscape(cursor)
+		}
+		var resp models.MessageHistoryResponse
+		decode(t, expectStatus(t, app, http.StatusOK, http.MethodGet, path, alice.Token, nil), &resp)
+		if len(resp.Messages) > 3 || page > 3 {
+			t.Fatalf("got page %d of %d messages", page, len(resp.Messages))
+		}
+		// Pages are in chronological order, each older than the previous.
+		texts := make([]string, 0, len(resp.Messages))
+		for _, msg := range resp.Messages {
+			texts = append(texts, msg.Message)
+		}
+		got = append(texts, got...)
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got history %v, want %v", got, want)
+	}
+
+	expectStatus(t, app, http.StatusBadRequest, http.MethodGet, "/message/v1/history?before=yesterday", alice.Token, nil)
+	expectStatus(t, app, http.StatusBadRequest, http.MethodGet, "/message/v1/history?limit=0", alice.Token, nil)
+}
+
+func TestReactions(t *testing.T) {
+	app, repos := newTestApp(t)
+	register(t, app, "alice1")
+	register(t, app, "bobby1")
+	alice := login(t, app, "alice1")
+	bob := login(t, app, "bobby1")
+	msg := insertMessage(t, repos, "alice1", "hello", time.Now())
+	path := "/message/v1/" + msg.ID.Hex() + "/reactions"
+
+	var resp models.MessagePayload
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPost, path, alice.Token, fiber.Map{"emoji": "👍"}), &resp)
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPost, path, bob.Token, fiber.Map{"emoji": "👍"}), &resp)
+	// Reacting twice with the same emoji counts once.
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPost, path, bob.Token, fiber.Map{"emoji": "👍"}), &resp)
+	if reaction := resp.Reactions["👍"]; reaction.Count != 2 {
+		t.Fatalf("got reaction %+v, want 2 users", reaction)
+	}
+
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodDelete, path+"/"+url.PathEscape("👍"), bob.Token, nil), &resp)
+	if reaction := resp.Reactions["👍"]; reaction.Count != 1 || reaction.Users[0] != "alice1" {
+		t.Fatalf("got reaction %+v, want alice1 only", reaction)
+	}
+
+	expectStatus(t, app, http.StatusBadRequest, http.MethodPost, path, bob.Token, fiber.Map{"emoji": ""})
+	expectStatus(t, app, http.StatusNotFound, http.MethodPost, "/message/v1/000000000000000000000000/reactions", bob.Token, fiber.Map{"emoji": "👍"})
+}
+
+func TestReadMarkerUnreadCount(t *testing.T) {
+	app, repos := newTestApp(t)
+	register(t, app, "alice1")
+	register(t, app, "bobby1")
+	alice := login(t, app, "alice1")
+	date := time.Now().Truncate(time.Millisecond)
+	first := insertMessage(t, repos, "bobby1", "one", date)
+	second := insertMessage(t, repos, "bobby1", "two", date)
+	insertMessage(t, repos, "bobby1", "three", date.Add(time.Second))
+	deleted := insertMessage(t, repos, "bobby1", "four", date.Add(2*time.Second))
+	if _, err := repos.Messages.SoftDeleteMessage(context.Background(), deleted.ID, "bobby1", time.Now()); err != nil {
+		t.Fatalf("SoftDeleteMessage: %v", err)
+	}
+
+	expectUnread := func(read models.MessagePayload, want int64) {
+		t.Helper()
+		expectStatus(t, app, http.StatusOK, http.MethodPut, "/message/v1/read-marker", alice.Token, fiber.Map{"message_id": read.ID.Hex()})
+		var marker models.ReadMarker
+		decode(t, expectStatus(t, app, http.StatusOK, http.MethodGet, "/message/v1/read-marker", alice.Token, nil), &marker)
+		if marker.MessageID != read.ID || marker.UnreadCount != want {
+			t.Fatalf("got marker %s with %d unread, want %s with %d", marker.MessageID.Hex(), marker.UnreadCount, read.ID.Hex(), want)
+		}
+	}
+	// Messages sent within the same millisecond as the read one are still unread, the
+	// deleted one is not.
+	expectUnread(first, 2)
+	expectUnread(second, 1)
+}
+
+func TestEditMessageByModerator(t *testing.T) {
+	app, repos := newTestApp(t)
+	createUser(t, repos, "moder1", models.RoleModerator)
+	register(t, app, "alice1")
+	register(t, app, "bobby1")
+	moderator := login(t, app, "moder1")
+	bob := login(t, app, "bobby1")
+	msg := insertMessage(t, repos, "alice1", "hello", time.Now())
+	path := "/message/v1/" + msg.ID.Hex()
+
+	expectStatus(t, app, http.StatusForbidden, http.MethodPut, path, bob.Token, fiber.Map{"message": "edited"})
+
+	var resp models.MessagePayload
+	decode(t, expectStatus(t, app, http.StatusOK, http.MethodPut, path, moderator.Token, fiber.Map{"message": "edited"}), &resp)
+	if resp.Message != "edited" || len(resp.Edits) != 1 || resp.Edits[0].EditedBy != "moder1" {
+		t.Fatalf("got edited message %+v", resp)
+	}
+}
+
+// writeKeysFile writes a keys file holding a signing key of alg, see
+// jwt_token.LoadKeySet, and returns its path.
+func writeKeysFile(t *testing.T, alg string) string {
+	t.Helper()
+
+	var (
+		privateKey interface{}
+		err        error
+	)
+	if alg == "RS256" {
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("failed to generate %s key: %v", alg, err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to encode %s key: %v", alg, err)
+	}
+
+	dir := t.TempDir()
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = os.WriteFile(filepath.Join(dir, "key.pem"), pemData, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	keys := fmt.Sprintf(`{"keys": [{"kid": "test", "alg": %q, "private_key": "key.pem"}]}`, alg)
+	path := filepath.Join(dir, "keys.json")
+	if err = os.WriteFile(path, []byte(keys), 0o600); err != nil {
+		t.Fatalf("failed to write keys file: %v", err)
+	}
+	return path
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	for _, alg := range []string{"RS256", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			app, _ := newTestAppWithEnv(t, map[string]string{"JWT_KEYS_FILE": writeKeysFile(t, alg)})
+			register(t, app, "alice1")
+			first := login(t, app, "alice1")
+			// Sessions store token hashes, tokens this long would not fit a column.
+			if len(first.Token) <= 255 || len(first.RefreshToken) <= 255 {
+				t.Fatalf("got %s tokens of %d and %d bytes", alg, len(first.Token), len(first.RefreshToken))
+			}
+			expectStatus(t, app, http.StatusOK, http.MethodGet, "/user/v1/sessions", first.Token, nil)
+
+			var second models.LoginResponse
+			decode(t, expectStatus(t, app, http.StatusOK, http.MethodPut, "/user/v1/refresh-token", first.RefreshToken, nil), &second)
+			expectStatus(t, app, http.StatusOK, http.MethodGet, "/user/v1/sessions", second.Token, nil)
+			expectStatus(t, app, http.StatusUnauthorized, http.MethodPut, "/user/v1/refresh-token", first.RefreshToken, nil)
+			expectStatus(t, app, http.StatusUnauthorized, http.MethodGet, "/user/v1/sessions", second.Token, nil)
+		})
+	}
+}
+
+// newThrottledTestApp is newTestApp with the login throttle configured by vars.
+func newThrottledTestApp(t *testing.T, vars map[string]string) (*fiber.App, repository.Repositories) {
+	t.Helper()
+
+	settings := map[string]string{
+		"APP_SECRET":              "test secret",
+		"LOGIN_FREE_ATTEMPTS":     "3",
+		"LOGIN_IP_FREE_ATTEMPTS":  "20",
+		"LOGIN_BACKOFF_BASE":      "1h",
+		"LOGIN_BACKOFF_MAX":       "1h",
+		"LOGIN_LOCKOUT_THRESHOLD": "10",
+		"LOGIN_LOCKOUT_DURATION":  "1h",
+		"LOGIN_ATTEMPT_WINDOW":    "1h",
+	}
+	for key, value := range vars {
+		settings[key] = value
+	}
+	return newTestAppWithEnv(t, settings)
+}
+
+// loginStatus attempts a login and returns the status of the response. It may be
+// called from any goroutine.
+func loginStatus(app *fiber.App, username string, password string) (int, error) {
+	body := fmt.Sprintf(`{"username": %q, "password": %q}`, username, password)
+	req := httptest.NewRequest(http.MethodPost, "/user/v1/login", strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func expectLogin(t *testing.T, app *fiber.App, username string, password string, status int) {
+	t.Helper()
+
+	got, err := loginStatus(app, username, password)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if got != status {
+		t.Fatalf("login of %s = %d, want %d", username, got, status)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	app, _ := newThrottledTestApp(t, nil)
+	register(t, app, "alice1")
+
+	for i := 0; i < 4; i++ {
+		expectLogin(t, app, "alice1", "wrong password", http.StatusNotFound)
+	}
+	expectLogin(t, app, "alice1", testPassword, http.StatusTooManyRequests)
+}
+
+func TestLoginLockout(t *testing.T) {
+	app, repos := newThrottledTestApp(t, map[string]string{"LOGIN_LOCKOUT_THRESHOLD": "3"})
+	events := &securityEventRecorder{}
+	repos.SecurityEvents = events
+	controllers.SetupRepositories(repos)
+	register(t, app, "alice1")
+
+	for i := 0; i < 3; i++ {
+		expectLogin(t, app, "alice1", "wrong password", http.StatusNotFound)
+	}
+	expectLogin(t, app, "alice1", testPassword, http.StatusLocked)
+	if len(events.events) != 1 || events.events[0].Event != models.SecurityEventAccountLocked {
+		t.Fatalf("got security events %+v, want an account lockout", events.events)
+	}
+}
+
+func TestLoginThrottleCountsConcurrentAttempts(t *testing.T) {
+	app, _ := newThrottledTestApp(t, nil)
+	register(t, app, "alice1")
+
+	var (
+		wg       sync.WaitGroup
+		statuses = make(chan int, 10)
+		errs     = make(chan error, 10)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := loginStatus(app, "alice1", "wrong password")
+			if err != nil {
+				errs <- err
+				return
+			}
+			statuses <- status
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	close(errs)
+	for err := range errs {
+		t.Fatalf("login: %v", err)
+	}
+
+	// The three free attempts and the one whose failure starts the backoff.
+	checked := 0
+	for status := range statuses {
+		if status == http.StatusNotFound {
+			checked++
+		} else if status != http.StatusTooManyRequests {
+			t.Fatalf("got login status %d", status)
+		}
+	}
+	if checked != 4 {
+		t.Fatalf("%d of 10 concurrent attempts were checked, want 4", checked)
+	}
+}
+
+func TestSuccessfulLoginsDoNotCountForTheIPAddress(t *testing.T) {
+	app, _ := newThrottledTestApp(t, map[string]string{"LOGIN_IP_FREE_ATTEMPTS": "1"})
+	register(t, app, "alice1")
+
+	for i := 0; i < 3; i++ {
+		expectLogin(t, app, "alice1", testPassword, http.StatusOK)
+	}
+}
+
+func TestUnknownUsernamesOnlyCountForTheIPAddress(t *testing.T) {
+	app, _ := newThrottledTestApp(t, map[string]string{"LOGIN_FREE_ATTEMPTS": "1", "LOGIN_IP_FREE_ATTEMPTS": "3"})
+
+	// The username has no counter that could block it after its first failure.
+	for i := 0; i < 4; i++ {
+		expectLogin(t, app, "ghost1", "wrong password", http.StatusNotFound)
+	}
+	expectLogin(t, app, "ghost2", "wrong password", http.StatusTooManyRequests)
+}
+
+func TestDeleteForgottenLoginThrottles(t *testing.T) {
+	repos := repository.NewMemoryRepositories()
+	ctx := context.Background()
+	now := time.Now()
+	noBlock := func(int) (time.Duration, bool) { return 0, false }
+	locked := func(int) (time.Duration, bool) { return 2 * time.Hour, true }
+	for key, attempt := range map[string]struct {
+		at    time.Time
+		block repository.LoginBlockFunc
+	}{
+		"ip:old1":   {now.Add(-2 * time.Hour), noBlock},
+		"ip:old2":   {now.Add(-2 * time.Hour), noBlock},
+		"ip:recent": {now.Add(-time.Minute), noBlock},
+		"user:lock": {now.Add(-90 * time.Minute), locked},
+	} {
+		if _, _, err := repos.LoginThrottles.ReserveLoginAttempt(ctx, key, attempt.at, time.Hour, attempt.block); err != nil {
+			t.Fatalf("ReserveLoginAttempt: %v", err)
+		}
+	}
+	// Neither recent failures nor ones still blocking logins are forgotten.
+	deleted, err := repos.LoginThrottles.DeleteForgottenLoginThrottles(ctx, now.Add(-time.Hour), now, 1)
+	if err != nil || deleted != 1 {
+		t.Fatalf("got %d deleted, %v, want 1 within the limit", deleted, err)
+	}
+	deleted, err = repos.LoginThrottles.DeleteForgottenLoginThrottles(ctx, now.Add(-time.Hour), now, 10)
+	if err != nil || deleted != 1 {
+		t.Fatalf("got %d deleted, %v, want the other old counter", deleted, err)
+	}
+}